@@ -0,0 +1,79 @@
+package multicluster_gw
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// defaultClusterName is the name of the cluster we watch when no kubeconfig is given.
+const defaultClusterName = "local"
+
+// Cluster is a k8s cluster that the plugin watches for ServiceImports.
+type Cluster struct {
+	Name         string
+	ClientConfig clientcmd.ClientConfig
+}
+
+// getClientConfig returns the rest config of the cluster. If a kubeconfig was given
+// in the corefile it is used, otherwise we fallback to the in-cluster config.
+func (c Cluster) getClientConfig() (*rest.Config, error) {
+	if c.ClientConfig != nil {
+		cfg, err := c.ClientConfig.ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("unable to load kubeconfig of cluster '%s': %w", c.Name, err)
+		}
+		return cfg, nil
+	}
+	cfg, err := ctrl.GetConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load in-cluster config: %w", err)
+	}
+	return cfg, nil
+}
+
+// newManager creates a controller manager that runs a ServiceImportReconciler against the cluster,
+// reporting the ServiceImports it finds to store, and the loss of the connection to stale (if it isn't nil).
+func (c Cluster) newManager(store *Store, stale *staleTracker) (manager.Manager, error) {
+	cfg, err := c.getClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+		Scheme: scheme,
+		// The metrics and health endpoints are disabled: CoreDNS already serves its own, and
+		// the managers of the different clusters would fight over the same ports.
+		MetricsBindAddress:     "0",
+		HealthProbeBindAddress: "0",
+		Port:                   9443,
+		// Every CoreDNS replica needs its own view of the ServiceImports, so no leader election.
+		LeaderElection: false,
+		NewCache:       cache.BuilderWithOptions(cache.Options{SelectorsByObject: cacheSelectors()}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create manager for cluster '%s': %w", c.Name, err)
+	}
+
+	if err = (&ServiceImportReconciler{
+		Client:      mgr.GetClient(),
+		Scheme:      mgr.GetScheme(),
+		ClusterName: c.Name,
+		Store:       store,
+	}).SetupWithManager(mgr); err != nil {
+		return nil, fmt.Errorf("unable to create ServiceImport controller for cluster '%s': %w", c.Name, err)
+	}
+	//+kubebuilder:scaffold:builder
+
+	if stale != nil {
+		if err = watchConnection(mgr, c.Name, stale); err != nil {
+			return nil, fmt.Errorf("unable to watch the connection to cluster '%s': %w", c.Name, err)
+		}
+	}
+
+	return mgr, nil
+}
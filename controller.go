@@ -2,26 +2,64 @@ package multicluster_gw
 
 import (
 	"context"
+	"net"
+	"strconv"
+	"strings"
 
 	"github.com/go-logr/logr"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	gatewayv1b1 "sigs.k8s.io/gateway-api/apis/v1beta1"
 	mcsv1a "sigs.k8s.io/mcs-api/pkg/apis/v1alpha1"
 )
 
+// LabelSourceCluster is the label of a multicluster EndpointSlice with the id of the cluster it came from.
+const LabelSourceCluster = "multicluster.kubernetes.io/source-cluster"
+
+// AnswerModeAnnotation overrides, per ServiceImport, if its ClusterSetIPs ("clusterset-ip")
+// or the gateway ("gateway") are answered for it.
+const AnswerModeAnnotation = "multicluster-gw/answer"
+
+// GatewayIPAnnotation overrides, per ServiceImport, the gateway addresses it is answered with.
+// Its value is a comma separated list of addresses.
+const GatewayIPAnnotation = "multicluster-gw/gateway-ip"
+
+// GatewayRefAnnotation overrides, per ServiceImport, the gateway it is answered with, by a gateway.networking.k8s.io
+// Gateway ([NAMESPACE/]NAME, in the namespace of the ServiceImport if no namespace is given), whose addresses are answered.
+const GatewayRefAnnotation = "multicluster-gw/gateway-ref"
+
+// gatewayRefIndex is the field index of the ServiceImports by the Gateway they refer to (see gatewayRefOf),
+// so a change of a Gateway lists only its ServiceImports.
+const gatewayRefIndex = "gatewayRef"
+
+// TTLAnnotation overrides, per ServiceImport, the TTL (in seconds) of its records.
+const TTLAnnotation = "multicluster-gw/ttl"
+
 // ServiceImportReconciler reconciles a ServiceImport object
 type ServiceImportReconciler struct {
 	client.Client
-	Log    logr.Logger
-	Scheme *runtime.Scheme
+	Log         logr.Logger
+	Scheme      *runtime.Scheme
+	ClusterName string // the name of the cluster the reconciler watches
+	Store       *Store // the store of the plugin instance the reconciler reports to
 }
 
 //+kubebuilder:rbac:groups=app.my.domain,resources=serviceimports,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=app.my.domain,resources=serviceimports/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=app.my.domain,resources=serviceimports/finalizers,verbs=update
+//+kubebuilder:rbac:groups=discovery.k8s.io,resources=endpointslices,verbs=get;list;watch
+//+kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=gateways,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -38,9 +76,9 @@ func (r *ServiceImportReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 	if err != nil {
 		if errors.IsNotFound(err) {
 			log.Info("ServiceImport resource not found. Assume the corresponding SI was deleted")
-			log.Info("Removing ServiceImport from the set:")
+			log.Info("Removing ServiceImport from the store:")
 			// deleting the service name and ns:
-			Mcgw.SISet.Delete(GenerateNameAsString(siNameNs.Name, siNameNs.Namespace))
+			r.Store.Delete(r.ClusterName, siNameNs)
 
 			return ctrl.Result{}, nil
 		}
@@ -51,21 +89,215 @@ func (r *ServiceImportReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 
 	// if we got here (the err is nil), the serviceImport is existing, so its a new ServiceImport:
 
+	info := NewServiceImportInfo(si)
+	if si.Spec.Type == mcsv1a.Headless {
+		// a headless SI is resolved to its endpoints:
+		info.Endpoints, err = r.getEndpoints(ctx, siNameNs)
+		if err != nil {
+			log.Error(err, "Failed to list the EndpointSlices of the ServiceImport")
+			return ctrl.Result{}, err
+		}
+	}
+	if ref, exists := gatewayRefOf(si); exists {
+		// the ServiceImport is answered with the addresses of its own gateway:
+		gatewayIPs, err := r.getGatewayAddresses(ctx, ref)
+		if err != nil {
+			log.Error(err, "Failed to get the Gateway of the ServiceImport")
+			return ctrl.Result{}, err
+		}
+		info.GatewayIPs = mergeIPs(info.GatewayIPs, gatewayIPs)
+	}
+
 	// add it to the data structure:
-	Mcgw.SISet.Add(GenerateNameAsString(siNameNs.Name, siNameNs.Namespace))
+	r.Store.Add(r.ClusterName, siNameNs, info)
 
 	return ctrl.Result{}, nil
 }
 
+// getEndpoints returns the ready endpoints of the multicluster EndpointSlices of the ServiceImport.
+// The cluster of every endpoint is taken from the source cluster label of its EndpointSlice,
+// or is the cluster we watch if there is no such label.
+func (r *ServiceImportReconciler) getEndpoints(ctx context.Context, siNameNs types.NamespacedName) ([]Endpoint, error) {
+	epsList := &discoveryv1.EndpointSliceList{}
+	err := r.List(ctx, epsList, client.InNamespace(siNameNs.Namespace),
+		client.MatchingLabels{mcsv1a.LabelServiceName: siNameNs.Name})
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []Endpoint
+	for _, eps := range epsList.Items {
+		clusterID := eps.Labels[LabelSourceCluster]
+		if clusterID == "" {
+			clusterID = r.ClusterName
+		}
+		for _, ep := range eps.Endpoints {
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			endpoint := Endpoint{ClusterID: clusterID}
+			if ep.Hostname != nil {
+				endpoint.Hostname = *ep.Hostname
+			}
+			for _, address := range ep.Addresses {
+				if ip := net.ParseIP(address); ip != nil {
+					endpoint.IPs = append(endpoint.IPs, ip)
+				}
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints, nil
+}
+
+// getGatewayAddresses returns the IP addresses of the Gateway. A Gateway that doesn't exist
+// (or a cluster without Gateways at all) has no addresses.
+func (r *ServiceImportReconciler) getGatewayAddresses(ctx context.Context, ref types.NamespacedName) ([]net.IP, error) {
+	gateway := &gatewayv1b1.Gateway{}
+	err := r.Get(ctx, ref, gateway)
+	if errors.IsNotFound(err) || meta.IsNoMatchError(err) {
+		log.Warningf("The Gateway %s was not found", ref)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sourceAddresses(gateway), nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
+// Changes of the multicluster EndpointSlices trigger the reconcile of their ServiceImport, and so do
+// changes of Gateways, of the ServiceImports that refer to them (if the cluster has Gateways).
 func (r *ServiceImportReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	b := ctrl.NewControllerManagedBy(mgr).
 		// Uncomment the following line adding a pointer to an instance of the controlled resource as an argument
 		For(&mcsv1a.ServiceImport{}).
-		Complete(r)
+		Watches(&source.Kind{Type: &discoveryv1.EndpointSlice{}}, handler.EnqueueRequestsFromMapFunc(endpointSliceToServiceImport))
+
+	_, err := mgr.GetRESTMapper().RESTMapping(gatewayGroupKind, gatewayv1b1.GroupVersion.Version)
+	switch {
+	case err == nil:
+		if err := mgr.GetFieldIndexer().IndexField(context.Background(), &mcsv1a.ServiceImport{}, gatewayRefIndex, indexGatewayRef); err != nil {
+			return err
+		}
+		b = b.Watches(&source.Kind{Type: &gatewayv1b1.Gateway{}}, handler.EnqueueRequestsFromMapFunc(r.gatewayToServiceImports))
+	case meta.IsNoMatchError(err):
+		log.Infof("Not watching Gateways of cluster '%s', their API isn't installed: %v", r.ClusterName, err)
+	default:
+		// the API server couldn't tell, the manager is built again later
+		return err
+	}
+	return b.Complete(r)
+}
+
+// gatewayToServiceImports maps a Gateway to the requests of the ServiceImports that refer to it.
+func (r *ServiceImportReconciler) gatewayToServiceImports(obj client.Object) []reconcile.Request {
+	gatewayName := types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	siList := &mcsv1a.ServiceImportList{}
+	if err := r.List(context.Background(), siList, client.MatchingFields{gatewayRefIndex: gatewayName.String()}); err != nil {
+		log.Errorf("Failed to list the ServiceImports that refer to Gateway %s: %v", gatewayName, err)
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(siList.Items))
+	for _, si := range siList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: si.Name, Namespace: si.Namespace}})
+	}
+	return requests
+}
+
+// indexGatewayRef returns the value of the gatewayRefIndex of a ServiceImport: the Gateway it refers to, if it does.
+func indexGatewayRef(obj client.Object) []string {
+	si, ok := obj.(*mcsv1a.ServiceImport)
+	if !ok {
+		return nil
+	}
+	if ref, exists := gatewayRefOf(si); exists {
+		return []string{ref.String()}
+	}
+	return nil
+}
+
+// gatewayRefOf returns the Gateway that the ServiceImport refers to by its annotation, if it does.
+func gatewayRefOf(si *mcsv1a.ServiceImport) (types.NamespacedName, bool) {
+	ref := si.Annotations[GatewayRefAnnotation]
+	if ref == "" {
+		return types.NamespacedName{}, false
+	}
+	parts := strings.Split(ref, "/")
+	switch {
+	case len(parts) == 1:
+		return types.NamespacedName{Namespace: si.Namespace, Name: parts[0]}, true
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		return types.NamespacedName{Namespace: parts[0], Name: parts[1]}, true
+	}
+	log.Warningf("Ignoring invalid %s annotation '%s' of ServiceImport %s/%s", GatewayRefAnnotation, ref, si.Namespace, si.Name)
+	return types.NamespacedName{}, false
+}
+
+// cacheSelectors restricts the cache of the EndpointSlices to the multicluster ones, that have the service name
+// label, so the managers don't cache all the EndpointSlices of the cluster.
+func cacheSelectors() cache.SelectorsByObject {
+	hasServiceName, err := labels.NewRequirement(mcsv1a.LabelServiceName, selection.Exists, nil)
+	if err != nil {
+		// the label is a constant, it is always valid
+		panic(err)
+	}
+	return cache.SelectorsByObject{
+		&discoveryv1.EndpointSlice{}: {Label: labels.NewSelector().Add(*hasServiceName)},
+	}
 }
 
-// generate a name and ns as string in a constant format
-func GenerateNameAsString(name string, ns string) string {
-	return name + "." + ns
+// endpointSliceToServiceImport maps a multicluster EndpointSlice to a request of its ServiceImport.
+func endpointSliceToServiceImport(obj client.Object) []reconcile.Request {
+	siName, exists := obj.GetLabels()[mcsv1a.LabelServiceName]
+	if !exists {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: siName, Namespace: obj.GetNamespace()}}}
+}
+
+// NewServiceImportInfo returns the info we keep in the store about the ServiceImport.
+func NewServiceImportInfo(si *mcsv1a.ServiceImport) *ServiceImportInfo {
+	info := &ServiceImportInfo{
+		Type:  si.Spec.Type,
+		Ports: append([]mcsv1a.ServicePort(nil), si.Spec.Ports...),
+	}
+	for _, ipAsString := range si.Spec.IPs {
+		if ip := net.ParseIP(ipAsString); ip != nil {
+			info.IPs = append(info.IPs, ip)
+		}
+	}
+	switch mode := si.Annotations[AnswerModeAnnotation]; mode {
+	case answerGateway, answerClusterSetIP:
+		info.AnswerMode = mode
+	case "":
+	default:
+		log.Warningf("Ignoring unknown %s annotation '%s' of ServiceImport %s/%s", AnswerModeAnnotation, mode, si.Namespace, si.Name)
+	}
+	if gatewayIPs := si.Annotations[GatewayIPAnnotation]; gatewayIPs != "" {
+		for _, ipAsString := range strings.Split(gatewayIPs, ",") {
+			ip := net.ParseIP(strings.TrimSpace(ipAsString))
+			if ip == nil {
+				log.Warningf("Ignoring invalid address '%s' in the %s annotation of ServiceImport %s/%s", ipAsString, GatewayIPAnnotation, si.Namespace, si.Name)
+				continue
+			}
+			if ip.To4() != nil {
+				ip = ip.To4()
+			}
+			info.GatewayIPs = append(info.GatewayIPs, ip)
+		}
+	}
+	if ref, exists := gatewayRefOf(si); exists {
+		info.GatewayRef = ref.String()
+	}
+	if ttlAsString, exists := si.Annotations[TTLAnnotation]; exists {
+		ttl, err := strconv.ParseUint(ttlAsString, 10, 32)
+		if err != nil || ttl > maxTTL {
+			log.Warningf("Ignoring invalid %s annotation '%s' of ServiceImport %s/%s", TTLAnnotation, ttlAsString, si.Namespace, si.Name)
+		} else {
+			ttl32 := uint32(ttl)
+			info.TTL = &ttl32
+		}
+	}
+	return info
 }
@@ -2,11 +2,15 @@ package multicluster_gw
 
 import (
 	"context"
+	"net"
 	"testing"
 
 	"github.com/go-logr/logr"
 	"github.com/stretchr/testify/require"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 
@@ -14,6 +18,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	gatewayv1b1 "sigs.k8s.io/gateway-api/apis/v1beta1"
 	mcsv1a1 "sigs.k8s.io/mcs-api/pkg/apis/v1alpha1"
 )
 
@@ -21,6 +26,7 @@ const (
 	serviceName = "svc"
 	serviceNS   = "svc-ns"
 	cluster1    = "c1"
+	cluster2    = "c2"
 )
 
 var (
@@ -44,7 +50,7 @@ var (
 
 func TestController(t *testing.T) {
 	tests := []struct {
-		shouldAddToSet   bool
+		shouldAddToStore bool
 		shouldErr        bool // True if test case is expected to produce an error.
 		preloadedObjects []runtime.Object
 	}{
@@ -68,11 +74,12 @@ func TestController(t *testing.T) {
 	for _, test := range tests {
 
 		ser := ServiceImportReconciler{
-			Client: getClient(test.preloadedObjects),
-			Log:    logr.Logger{},
-			Scheme: getScheme(),
+			Client:      getClient(test.preloadedObjects),
+			Log:         logr.Logger{},
+			Scheme:      getScheme(),
+			ClusterName: cluster1,
+			Store:       NewStore(),
 		}
-		Mcgw.SISet = *NewSiSet()
 		req := reconcile.Request{
 			NamespacedName: types.NamespacedName{
 				Name:      serviceImport.GetName(),
@@ -84,8 +91,238 @@ func TestController(t *testing.T) {
 			assert.Nil(err)
 			assert.False(result.Requeue, "unexpected requeue")
 		}
-		isContains := Mcgw.SISet.Contains(GenerateNameAsString(serviceImport.GetName(), serviceImport.GetNamespace()))
-		assert.Equal(test.shouldAddToSet, isContains)
+		isContains := ser.Store.Contains(types.NamespacedName{Namespace: serviceImport.GetNamespace(), Name: serviceImport.GetName()})
+		assert.Equal(test.shouldAddToStore, isContains)
+	}
+}
+
+// TestControllerMultipleClusters checks that a ServiceImport stays in the store as long as one of the clusters has it.
+func TestControllerMultipleClusters(t *testing.T) {
+	assert := require.New(t)
+	store := NewStore()
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      serviceImport.GetName(),
+			Namespace: serviceImport.GetNamespace(),
+		}}
+	siName := types.NamespacedName{Namespace: serviceImport.GetNamespace(), Name: serviceImport.GetName()}
+
+	withSI := ServiceImportReconciler{
+		Client:      getClient([]runtime.Object{serviceImport}),
+		Scheme:      getScheme(),
+		ClusterName: cluster1,
+		Store:       store,
+	}
+	withoutSI := ServiceImportReconciler{
+		Client:      getClient([]runtime.Object{}),
+		Scheme:      getScheme(),
+		ClusterName: cluster2,
+		Store:       store,
+	}
+
+	// only one cluster has the SI:
+	_, err := withSI.Reconcile(context.TODO(), req)
+	assert.Nil(err)
+	_, err = withoutSI.Reconcile(context.TODO(), req)
+	assert.Nil(err)
+	assert.True(store.Contains(siName))
+
+	// the SI was deleted from the only cluster that had it:
+	withSI.Client = getClient([]runtime.Object{})
+	_, err = withSI.Reconcile(context.TODO(), req)
+	assert.Nil(err)
+	assert.False(store.Contains(siName))
+}
+
+// TestControllerSeparateStores checks that reconcilers of different plugin instances don't share a store.
+func TestControllerSeparateStores(t *testing.T) {
+	assert := require.New(t)
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      serviceImport.GetName(),
+			Namespace: serviceImport.GetNamespace(),
+		}}
+	siName := types.NamespacedName{Namespace: serviceImport.GetNamespace(), Name: serviceImport.GetName()}
+
+	first := ServiceImportReconciler{
+		Client:      getClient([]runtime.Object{serviceImport}),
+		Scheme:      getScheme(),
+		ClusterName: cluster1,
+		Store:       NewStore(),
+	}
+	second := ServiceImportReconciler{
+		Client:      getClient([]runtime.Object{}),
+		Scheme:      getScheme(),
+		ClusterName: cluster1,
+		Store:       NewStore(),
+	}
+
+	_, err := first.Reconcile(context.TODO(), req)
+	assert.Nil(err)
+	_, err = second.Reconcile(context.TODO(), req)
+	assert.Nil(err)
+	assert.True(first.Store.Contains(siName))
+	assert.False(second.Store.Contains(siName))
+}
+
+// TestNewServiceImportInfo checks what we keep from a ServiceImport.
+func TestNewServiceImportInfo(t *testing.T) {
+	assert := require.New(t)
+	si := &mcsv1a1.ServiceImport{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   serviceNS,
+			Name:        serviceName,
+			Annotations: map[string]string{AnswerModeAnnotation: answerClusterSetIP},
+		},
+		Spec: mcsv1a1.ServiceImportSpec{
+			Type:  mcsv1a1.ClusterSetIP,
+			IPs:   []string{"10.0.0.10", "not-an-ip", "fd00::10"},
+			Ports: []mcsv1a1.ServicePort{{Name: "http", Port: 80}},
+		},
+	}
+
+	info := NewServiceImportInfo(si)
+	assert.Equal(mcsv1a1.ClusterSetIP, info.Type)
+	assert.Equal(answerClusterSetIP, info.AnswerMode)
+	assert.Equal([]net.IP{net.ParseIP("10.0.0.10"), net.ParseIP("fd00::10")}, info.IPs)
+	assert.Equal(si.Spec.Ports, info.Ports)
+
+	si.Annotations[AnswerModeAnnotation] = "something-else"
+	assert.Equal("", NewServiceImportInfo(si).AnswerMode)
+
+	// the gateway of the ServiceImport:
+	si.Annotations[GatewayIPAnnotation] = "6.6.6.6, bad-ip,fd00::6"
+	si.Annotations[GatewayRefAnnotation] = "gw"
+	info = NewServiceImportInfo(si)
+	assert.Equal([]net.IP{net.IPv4(6, 6, 6, 6).To4(), net.ParseIP("fd00::6")}, info.GatewayIPs)
+	assert.Equal(serviceNS+"/gw", info.GatewayRef)
+
+	si.Annotations[GatewayRefAnnotation] = "gw-ns/gw/other"
+	assert.Equal("", NewServiceImportInfo(si).GatewayRef)
+
+	// the TTL of the ServiceImport:
+	assert.Nil(info.TTL)
+	si.Annotations[TTLAnnotation] = "0"
+	assert.Equal(uint32(0), *NewServiceImportInfo(si).TTL)
+	si.Annotations[TTLAnnotation] = "1h"
+	assert.Nil(NewServiceImportInfo(si).TTL)
+	si.Annotations[TTLAnnotation] = "3601"
+	assert.Nil(NewServiceImportInfo(si).TTL)
+}
+
+// TestControllerGatewayRef checks that a ServiceImport that refers to a Gateway is kept with the Gateway's addresses.
+func TestControllerGatewayRef(t *testing.T) {
+	assert := require.New(t)
+	gatewaySI := &mcsv1a1.ServiceImport{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   serviceNS,
+			Name:        serviceName,
+			Annotations: map[string]string{GatewayRefAnnotation: "gw-ns/gw", GatewayIPAnnotation: "6.6.6.6"},
+		},
+	}
+	otherSI := &mcsv1a1.ServiceImport{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   serviceNS,
+			Name:        "other",
+			Annotations: map[string]string{GatewayRefAnnotation: "gw"},
+		},
+	}
+	gateway := &gatewayv1b1.Gateway{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "gw-ns", Name: "gw"},
+		Status: gatewayv1b1.GatewayStatus{Addresses: []gatewayv1b1.GatewayAddress{
+			{Value: "7.7.7.7"}, {Value: "6.6.6.6"},
+		}},
+	}
+	ser := ServiceImportReconciler{
+		Client:      getClient([]runtime.Object{gatewaySI, otherSI, gateway}),
+		Scheme:      getScheme(),
+		ClusterName: cluster1,
+		Store:       NewStore(),
+	}
+	ctx := context.TODO()
+
+	for _, si := range []*mcsv1a1.ServiceImport{gatewaySI, otherSI} {
+		_, err := ser.Reconcile(ctx, reconcile.Request{NamespacedName: types.NamespacedName{Name: si.Name, Namespace: si.Namespace}})
+		assert.Nil(err)
+	}
+	info, exists := ser.Store.Get(types.NamespacedName{Namespace: serviceNS, Name: serviceName})
+	assert.True(exists)
+	assert.Equal("gw-ns/gw", info.GatewayRef)
+	assert.Equal([]net.IP{net.IPv4(6, 6, 6, 6).To4(), net.IPv4(7, 7, 7, 7).To4()}, info.GatewayIPs)
+
+	// the Gateway of the other SI doesn't exist, so it has no gateway addresses:
+	info, exists = ser.Store.Get(types.NamespacedName{Namespace: serviceNS, Name: "other"})
+	assert.True(exists)
+	assert.Equal(serviceNS+"/gw", info.GatewayRef)
+	assert.Empty(info.GatewayIPs)
+
+	// the ServiceImports are indexed by the Gateway they refer to:
+	assert.Equal([]string{"gw-ns/gw"}, indexGatewayRef(gatewaySI))
+	assert.Equal([]string{serviceNS + "/gw"}, indexGatewayRef(otherSI))
+	assert.Empty(indexGatewayRef(&mcsv1a1.ServiceImport{ObjectMeta: metav1.ObjectMeta{Namespace: serviceNS, Name: "plain"}}))
+
+	// a change of the Gateway triggers the ServiceImports that refer to it. The fake client doesn't filter by
+	// the field index, so it has only the ServiceImport of the Gateway:
+	ser.Client = getClient([]runtime.Object{gatewaySI, gateway})
+	requests := ser.gatewayToServiceImports(gateway)
+	assert.Equal([]reconcile.Request{{NamespacedName: types.NamespacedName{Name: serviceName, Namespace: serviceNS}}}, requests)
+}
+
+// TestControllerHeadless checks that the endpoints of a headless ServiceImport are kept in the store.
+func TestControllerHeadless(t *testing.T) {
+	assert := require.New(t)
+	ready, notReady := true, false
+	hostname := "kafka-0"
+	headlessSI := &mcsv1a1.ServiceImport{
+		ObjectMeta: metav1.ObjectMeta{Namespace: serviceNS, Name: serviceName},
+		Spec:       mcsv1a1.ServiceImportSpec{Type: mcsv1a1.Headless},
+	}
+	newEndpointSlice := func(name string, labels map[string]string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+		return &discoveryv1.EndpointSlice{
+			ObjectMeta:  metav1.ObjectMeta{Namespace: serviceNS, Name: name, Labels: labels},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Endpoints:   endpoints,
+		}
+	}
+	objs := []runtime.Object{
+		headlessSI,
+		newEndpointSlice("from-c2", map[string]string{mcsv1a1.LabelServiceName: serviceName, LabelSourceCluster: cluster2},
+			discoveryv1.Endpoint{Addresses: []string{"10.0.2.1"}, Hostname: &hostname, Conditions: discoveryv1.EndpointConditions{Ready: &ready}},
+			discoveryv1.Endpoint{Addresses: []string{"10.0.2.2"}, Conditions: discoveryv1.EndpointConditions{Ready: &notReady}}),
+		newEndpointSlice("local", map[string]string{mcsv1a1.LabelServiceName: serviceName},
+			discoveryv1.Endpoint{Addresses: []string{"10.0.1.1"}}),
+		newEndpointSlice("other-service", map[string]string{mcsv1a1.LabelServiceName: "other"},
+			discoveryv1.Endpoint{Addresses: []string{"10.0.3.1"}}),
+	}
+	ser := ServiceImportReconciler{
+		Client:      getClient(objs),
+		Scheme:      getScheme(),
+		ClusterName: cluster1,
+		Store:       NewStore(),
+	}
+
+	_, err := ser.Reconcile(context.TODO(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Name: serviceName, Namespace: serviceNS}})
+	assert.Nil(err)
+
+	info, exists := ser.Store.Get(types.NamespacedName{Namespace: serviceNS, Name: serviceName})
+	assert.True(exists)
+	assert.ElementsMatch([]Endpoint{
+		{ClusterID: cluster2, Hostname: hostname, IPs: []net.IP{net.ParseIP("10.0.2.1")}},
+		{ClusterID: cluster1, IPs: []net.IP{net.ParseIP("10.0.1.1")}},
+	}, info.Endpoints)
+
+	// EndpointSlices are mapped to their ServiceImport:
+	assert.Equal([]reconcile.Request{{NamespacedName: types.NamespacedName{Name: serviceName, Namespace: serviceNS}}},
+		endpointSliceToServiceImport(objs[1].(client.Object)))
+	assert.Empty(endpointSliceToServiceImport(newEndpointSlice("no-label", nil)))
+
+	// only the multicluster EndpointSlices are cached:
+	selectors := cacheSelectors()
+	assert.Len(selectors, 1)
+	for _, selector := range selectors {
+		assert.True(selector.Label.Matches(labels.Set(objs[1].(client.Object).GetLabels())))
+		assert.False(selector.Label.Matches(labels.Set{}))
 	}
 }
 
@@ -114,6 +351,8 @@ func newLogger(t *testing.T, enabled bool) *logger {
 // return a scheme
 func getScheme() *runtime.Scheme {
 	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 	utilruntime.Must(mcsv1a1.AddToScheme(scheme))
+	utilruntime.Must(gatewayv1b1.AddToScheme(scheme))
 	return scheme
 }
@@ -0,0 +1,181 @@
+package multicluster_gw
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// The policies of choosing the gateway addresses to answer with.
+const (
+	policyAll        = "all"         // answer all the addresses
+	policyRoundRobin = "round_robin" // answer one address, the next one on every response
+	policyRandom     = "random"      // answer one random address
+	policyWeighted   = "weighted"    // answer one random address, by the weights of the addresses
+)
+
+// defaultGatewayWeight is the weight of a gateway address without a configured weight.
+const defaultGatewayWeight = 1
+
+// gatewayPool chooses which of the gateway addresses are answered in every response, by its policy.
+// If the addresses are health checked, only the healthy ones are answered. When none is healthy,
+// the addresses are answered by the allDown mode.
+// An address with weight 0 is drained: it isn't answered, unless all the addresses of its family are drained.
+// It is shared by the copies of the plugin, so the round robin goes on between the responses.
+type gatewayPool struct {
+	policy  string
+	weights map[string]int // the weights of the addresses, by their string form
+	health  *healthChecker // nil if the addresses aren't health checked
+	allDown string         // what to answer when all the addresses are unhealthy
+
+	mutex      sync.RWMutex
+	discovered map[string][]net.IP // the addresses discovered from every gateway source, by the source
+	next4      uint32              // (atomic) the round robin counter of the IPv4 addresses
+	next6      uint32              // (atomic) the round robin counter of the IPv6 addresses
+}
+
+func newGatewayPool() *gatewayPool {
+	return &gatewayPool{
+		policy:     policyAll,
+		weights:    make(map[string]int),
+		allDown:    allDownLastHealthy,
+		discovered: make(map[string][]net.IP),
+	}
+}
+
+// validPolicy returns if the policy is known.
+func validPolicy(policy string) bool {
+	switch policy {
+	case policyAll, policyRoundRobin, policyRandom, policyWeighted:
+		return true
+	}
+	return false
+}
+
+// validAllDownMode returns if the mode of answering when all the addresses are unhealthy is known.
+func validAllDownMode(mode string) bool {
+	switch mode {
+	case allDownFallthrough, allDownServfail, allDownLastHealthy:
+		return true
+	}
+	return false
+}
+
+// setDiscovered sets the addresses discovered from the gateway source.
+func (p *gatewayPool) setDiscovered(source string, ips []net.IP) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if sameIPs(p.discovered[source], ips) {
+		return
+	}
+	log.Infof("The gateway addresses of %s are %v", source, ips)
+	if len(ips) == 0 {
+		delete(p.discovered, source)
+		return
+	}
+	p.discovered[source] = ips
+}
+
+// discoveredAddresses returns the IPv4 and the IPv6 addresses discovered from all the gateway sources,
+// without duplicates.
+func (p *gatewayPool) discoveredAddresses() ([]net.IP, []net.IP) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	sources := make([]string, 0, len(p.discovered))
+	for source := range p.discovered {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	var ips []net.IP
+	for _, source := range sources {
+		for _, ip := range p.discovered[source] {
+			if !containsIP(ips, ip) {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return splitIPFamilies(ips)
+}
+
+// weight returns the weight of the gateway address.
+func (p *gatewayPool) weight(ip net.IP) int {
+	if weight, ok := p.weights[ip.String()]; ok {
+		return weight
+	}
+	return defaultGatewayWeight
+}
+
+// pick4 returns the IPv4 addresses to answer with, out of the gateway's IPv4 addresses.
+func (p *gatewayPool) pick4(ips []net.IP) []net.IP {
+	return p.pick(ips, &p.next4)
+}
+
+// pick6 returns the IPv6 addresses to answer with, out of the gateway's IPv6 addresses.
+func (p *gatewayPool) pick6(ips []net.IP) []net.IP {
+	return p.pick(ips, &p.next6)
+}
+
+func (p *gatewayPool) pick(ips []net.IP, next *uint32) []net.IP {
+	active := p.active(ips)
+	if len(active) <= 1 {
+		return active
+	}
+	switch p.policy {
+	case policyRoundRobin:
+		i := atomic.AddUint32(next, 1) - 1
+		return []net.IP{active[int(i%uint32(len(active)))]}
+	case policyRandom:
+		return []net.IP{active[rand.Intn(len(active))]}
+	case policyWeighted:
+		return []net.IP{p.weightedChoice(active)}
+	}
+	return active
+}
+
+// active returns the healthy addresses that aren't drained. If all of them are drained, all the healthy ones
+// are returned, as answering a drained gateway is better than answering nothing.
+func (p *gatewayPool) active(ips []net.IP) []net.IP {
+	if p.health != nil && len(ips) > 0 {
+		healthy := p.health.healthy(ips)
+		if len(healthy) == 0 {
+			if p.allDown != allDownLastHealthy {
+				return nil
+			}
+			healthy = p.health.lastHealthy(ips)
+		}
+		ips = healthy
+	}
+	active := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if p.weight(ip) > 0 {
+			active = append(active, ip)
+		}
+	}
+	if len(active) == 0 {
+		return ips
+	}
+	return active
+}
+
+// weightedChoice returns a random address out of the active ones, with a chance by its weight.
+func (p *gatewayPool) weightedChoice(active []net.IP) net.IP {
+	total := 0
+	for _, ip := range active {
+		total += p.weight(ip)
+	}
+	if total == 0 {
+		// all the addresses are drained
+		return active[rand.Intn(len(active))]
+	}
+	choice := rand.Intn(total)
+	for _, ip := range active {
+		choice -= p.weight(ip)
+		if choice < 0 {
+			return ip
+		}
+	}
+	return active[len(active)-1]
+}
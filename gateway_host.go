@@ -0,0 +1,169 @@
+package multicluster_gw
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/nonwriter"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// gatewayHostTimeout is the timeout of resolving the gateway host with a configured upstream.
+const gatewayHostTimeout = 2 * time.Second
+
+var errNoUpstreamAnswer = errors.New("no upstream answered")
+
+// gatewayHostCache keeps the addresses the gateway host was resolved to, per type, for the TTL of the upstream answer,
+// so flattening doesn't resolve the name on every request.
+type gatewayHostCache struct {
+	mutex   sync.Mutex
+	entries map[uint16]gatewayHostEntry
+	now     func() time.Time
+}
+
+type gatewayHostEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+func newGatewayHostCache() *gatewayHostCache {
+	return &gatewayHostCache{entries: make(map[uint16]gatewayHostEntry), now: time.Now}
+}
+
+// get returns the cached addresses of the type, and their remaining TTL. It returns false if they aren't cached,
+// or expired.
+func (c *gatewayHostCache) get(qtype uint16) ([]net.IP, uint32, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, exists := c.entries[qtype]
+	if !exists {
+		return nil, 0, false
+	}
+	remaining := entry.expires.Sub(c.now())
+	if remaining < time.Second {
+		delete(c.entries, qtype)
+		return nil, 0, false
+	}
+	return entry.ips, uint32(remaining / time.Second), true
+}
+
+// set caches the addresses of the type for the TTL. Addresses with a TTL of 0 aren't cached.
+func (c *gatewayHostCache) set(qtype uint16, ips []net.IP, ttl uint32) {
+	if ttl == 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[qtype] = gatewayHostEntry{ips: ips, expires: c.now().Add(time.Duration(ttl) * time.Second)}
+}
+
+// gatewayHostRecords returns the records of a ServiceImport that is answered with the gateway of the plugin,
+// when the gateway is given by name: a CNAME to the name. If flattening is on, A and AAAA requests are answered
+// with the addresses of the name instead, or with the CNAME if the name can't be resolved. The addresses are
+// cached for the TTL of their upstream answer, and answered with the shorter of the remaining TTL and ttl.
+func (m MulticlusterGw) gatewayHostRecords(ctx context.Context, state request.Request, ttl uint32) []dns.RR {
+	qtype := state.QType()
+	if m.gatewayHostFlatten && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
+		ips, upstreamTTL, cached := m.gatewayHostCache.get(qtype)
+		var err error
+		if !cached {
+			ips, upstreamTTL, err = m.resolveGatewayHost(ctx, state, qtype)
+			if err == nil {
+				m.gatewayHostCache.set(qtype, ips, upstreamTTL)
+			}
+		}
+		if err == nil {
+			if upstreamTTL < ttl {
+				ttl = upstreamTTL
+			}
+			if qtype == dns.TypeA {
+				return newARecords(state.QName(), ips, ttl)
+			}
+			return newAAAARecords(state.QName(), ips, ttl)
+		}
+		log.Warningf("Failed to resolve the gateway host %s, answering with a CNAME: %v", m.gatewayHost, err)
+	}
+	return []dns.RR{NewCNAMERecord(state.QName(), m.gatewayHost, ttl)}
+}
+
+// resolveGatewayHost returns the addresses of the type of the gateway host, and their TTL. It is resolved with the
+// configured upstreams (the first one that answers), or through the next plugin if there are none.
+func (m MulticlusterGw) resolveGatewayHost(ctx context.Context, state request.Request, qtype uint16) ([]net.IP, uint32, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(m.gatewayHost, qtype)
+	if len(m.gatewayHostUpstreams) == 0 {
+		nw := nonwriter.New(state.W)
+		if _, err := plugin.NextOrFailure(m.Name(), m.Next, ctx, nw, req); err != nil {
+			return nil, 0, err
+		}
+		if nw.Msg == nil || nw.Msg.Rcode != dns.RcodeSuccess {
+			return nil, 0, errors.New("the next plugin didn't resolve it")
+		}
+		ips, ttl := answerAddresses(nw.Msg, qtype)
+		return ips, ttl, nil
+	}
+
+	client := &dns.Client{Net: "udp", Timeout: gatewayHostTimeout}
+	err := errNoUpstreamAnswer
+	for _, server := range m.gatewayHostUpstreams {
+		var resp *dns.Msg
+		resp, _, err = client.ExchangeContext(ctx, req, server)
+		if err != nil {
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			err = errors.New(dns.RcodeToString[resp.Rcode] + " from " + server)
+			continue
+		}
+		ips, ttl := answerAddresses(resp, qtype)
+		return ips, ttl, nil
+	}
+	return nil, 0, err
+}
+
+// answerAddresses returns the addresses of the type in the answer of the response, and the TTL of the answer:
+// the shortest TTL of its records, of the CNAMEs too. If there are no addresses, it is the negative TTL of the SOA
+// in the authority section, if there is one. The owner names of the records aren't checked, as the answer may
+// follow a chain of CNAMEs.
+func answerAddresses(resp *dns.Msg, qtype uint16) ([]net.IP, uint32) {
+	var ips []net.IP
+	var ttl uint32
+	for i, rr := range resp.Answer {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			if qtype == dns.TypeA {
+				ips = append(ips, rr.A)
+			}
+		case *dns.AAAA:
+			if qtype == dns.TypeAAAA {
+				ips = append(ips, rr.AAAA)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		ttl = 0
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = soa.Minttl
+				if soa.Hdr.Ttl < ttl {
+					ttl = soa.Hdr.Ttl
+				}
+			}
+		}
+	}
+	return ips, ttl
+}
+
+// NewCNAMERecord returns a new CNAME record, pointing to the target.
+func NewCNAMERecord(name string, target string, ttl uint32) *dns.CNAME {
+	return &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME,
+		Class: dns.ClassINET, Ttl: ttl}, Target: target}
+}
@@ -0,0 +1,123 @@
+package multicluster_gw
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// answerGatewayHost answers the A requests of the gateway host, with a CNAME chain to its address.
+func answerGatewayHost(w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if r.Question[0].Name == "lb.example.com." && r.Question[0].Qtype == dns.TypeA {
+		m.Answer = []dns.RR{
+			test.CNAME("lb.example.com. 30 IN CNAME lb-1.example.com."),
+			test.A("lb-1.example.com. 30 IN A 6.6.6.6"),
+		}
+	}
+	w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+// TestMultiClusterGwGatewayHost checks the answers of a ServiceImport whose gateway is given by name.
+func TestMultiClusterGwGatewayHost(t *testing.T) {
+	upstream := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) { answerGatewayHost(w, r) })
+	defer upstream.Close()
+
+	tests := []struct {
+		flatten         bool
+		upstreams       []string
+		next            plugin.Handler
+		questionType    uint16
+		expectedAnswers []string // The expected answers, as strings.
+	}{
+		{false, nil, test.ErrorHandler(), dns.TypeA, []string{"myservice.test.svc.clusterset.local.\t5\tIN\tCNAME\tlb.example.com."}},
+		{false, nil, test.ErrorHandler(), dns.TypeTXT, []string{"myservice.test.svc.clusterset.local.\t5\tIN\tCNAME\tlb.example.com."}},
+		// flattened through the next plugin:
+		{true, nil, plugin.HandlerFunc(func(_ context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			return answerGatewayHost(w, r)
+		}), dns.TypeA, []string{"myservice.test.svc.clusterset.local.\t5\tIN\tA\t6.6.6.6"}},
+		// flattened through the upstream, the host has no IPv6 addresses:
+		{true, []string{upstream.Addr}, test.ErrorHandler(), dns.TypeA, []string{"myservice.test.svc.clusterset.local.\t5\tIN\tA\t6.6.6.6"}},
+		{true, []string{upstream.Addr}, test.ErrorHandler(), dns.TypeAAAA, nil},
+		// the next plugin fails, so the CNAME is answered:
+		{true, nil, test.ErrorHandler(), dns.TypeA, []string{"myservice.test.svc.clusterset.local.\t5\tIN\tCNAME\tlb.example.com."}},
+	}
+
+	ctx := context.TODO()
+	for i, tc := range tests {
+		mcgw := initMcgw()
+		initalizeStoreForTest(mcgw, "myservice", "test", true)
+		mcgw.Next = tc.next
+		mcgw.gatewayIp4 = nil
+		mcgw.gatewayHost = "lb.example.com."
+		mcgw.gatewayHostFlatten = tc.flatten
+		mcgw.gatewayHostUpstreams = tc.upstreams
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		r := new(dns.Msg)
+		r.SetQuestion(`myservice.test.svc.clusterset.local.`, tc.questionType)
+		_, err := mcgw.ServeDNS(ctx, rec, r)
+		assert.Nil(t, err, "Test %d", i)
+		assert.Equal(t, dns.RcodeSuccess, rec.Msg.Rcode, "Test %d", i)
+		var answers []string
+		for _, rr := range rec.Msg.Answer {
+			answers = append(answers, rr.String())
+		}
+		assert.Equal(t, tc.expectedAnswers, answers, "Test %d", i)
+	}
+}
+
+// TestMultiClusterGwGatewayHostCache checks that the flattened addresses are cached for the TTL of the upstream answer.
+func TestMultiClusterGwGatewayHostCache(t *testing.T) {
+	var queries int32
+	upstream := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = []dns.RR{test.A("lb.example.com. 3 IN A 6.6.6.6")}
+		w.WriteMsg(m)
+	})
+	defer upstream.Close()
+
+	mcgw := initMcgw()
+	initalizeStoreForTest(mcgw, "myservice", "test", true)
+	mcgw.gatewayIp4 = nil
+	mcgw.gatewayHost = "lb.example.com."
+	mcgw.gatewayHostFlatten = true
+	mcgw.gatewayHostUpstreams = []string{upstream.Addr}
+	now := time.Unix(1000, 0)
+	mcgw.gatewayHostCache.now = func() time.Time { return now }
+
+	ctx := context.TODO()
+	serve := func() string {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		r := new(dns.Msg)
+		r.SetQuestion(`myservice.test.svc.clusterset.local.`, dns.TypeA)
+		_, err := mcgw.ServeDNS(ctx, rec, r)
+		assert.Nil(t, err)
+		if !assert.Len(t, rec.Msg.Answer, 1) {
+			return ""
+		}
+		return rec.Msg.Answer[0].String()
+	}
+
+	// the upstream TTL is shorter than the configured one:
+	assert.Equal(t, "myservice.test.svc.clusterset.local.\t3\tIN\tA\t6.6.6.6", serve())
+	now = now.Add(time.Second)
+	assert.Equal(t, "myservice.test.svc.clusterset.local.\t2\tIN\tA\t6.6.6.6", serve())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queries))
+
+	// resolved again once the TTL expires:
+	now = now.Add(2 * time.Second)
+	assert.Equal(t, "myservice.test.svc.clusterset.local.\t3\tIN\tA\t6.6.6.6", serve())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+}
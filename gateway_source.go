@@ -0,0 +1,156 @@
+package multicluster_gw
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	gatewayv1b1 "sigs.k8s.io/gateway-api/apis/v1beta1"
+)
+
+// The kinds of the resources the gateway addresses can be discovered from.
+const (
+	gatewaySourceService = "Service" // the addresses of the load balancer of a Service
+	gatewaySourceGateway = "Gateway" // the addresses of a gateway.networking.k8s.io Gateway
+)
+
+// gatewayGroupKind is the group and the kind of the gateway.networking.k8s.io Gateways.
+var gatewayGroupKind = schema.GroupKind{Group: gatewayv1b1.GroupName, Kind: "Gateway"}
+
+// gatewaySource is a resource that the gateway addresses are discovered from.
+type gatewaySource struct {
+	kind string
+	name types.NamespacedName
+}
+
+func (s gatewaySource) String() string {
+	return s.kind + " " + s.name.String()
+}
+
+// newObject returns an empty object of the kind of the source.
+func (s gatewaySource) newObject() client.Object {
+	if s.kind == gatewaySourceGateway {
+		return &gatewayv1b1.Gateway{}
+	}
+	return &corev1.Service{}
+}
+
+// cacheSelectors restricts a cache to the source object, by its name in its namespace.
+func (s gatewaySource) cacheSelectors() cache.SelectorsByObject {
+	return cache.SelectorsByObject{
+		s.newObject(): {Field: fields.SelectorFromSet(fields.Set{
+			"metadata.namespace": s.name.Namespace,
+			"metadata.name":      s.name.Name,
+		})},
+	}
+}
+
+// sourceAddresses returns the IP addresses that the status of the source object reports.
+// Addresses that are hostnames are ignored.
+func sourceAddresses(obj client.Object) []net.IP {
+	var addresses []string
+	switch obj := obj.(type) {
+	case *corev1.Service:
+		for _, ingress := range obj.Status.LoadBalancer.Ingress {
+			addresses = append(addresses, ingress.IP)
+		}
+	case *gatewayv1b1.Gateway:
+		for _, address := range obj.Status.Addresses {
+			if address.Type == nil || *address.Type == gatewayv1b1.IPAddressType {
+				addresses = append(addresses, address.Value)
+			}
+		}
+	}
+
+	var ips []net.IP
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			ip = ip.To4()
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// GatewaySourceReconciler reconciles the resource that the gateway addresses are discovered from,
+// and reports its addresses to the gateway.
+type GatewaySourceReconciler struct {
+	client.Reader // the cache of the source, set by SetupWithManager
+	Source        gatewaySource
+	Gateway       *gatewayPool // the gateway of the plugin instance the reconciler reports to
+}
+
+//+kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
+//+kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=gateways,verbs=get;list;watch
+
+// Reconcile updates the discovered addresses of the gateway by the status of the source.
+// A source that doesn't exist has no addresses.
+func (r *GatewaySourceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	obj := r.Source.newObject()
+	err := r.Get(ctx, r.Source.name, obj)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			log.Warningf("The gateway source %s was not found", r.Source)
+			r.Gateway.setDiscovered(r.Source.String(), nil)
+			return ctrl.Result{}, nil
+		}
+		log.Errorf("Failed to get the gateway source %s: %v", r.Source, err)
+		return ctrl.Result{}, err
+	}
+
+	r.Gateway.setDiscovered(r.Source.String(), sourceAddresses(obj))
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager, watching only the source resource.
+// The source is watched through a cache of its own, that has only the source object, so the manager
+// doesn't cache all the Services or Gateways of the cluster. A Gateway source fails the setup if the
+// cluster doesn't have the Gateway API.
+func (r *GatewaySourceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Source.kind == gatewaySourceGateway {
+		if _, err := mgr.GetRESTMapper().RESTMapping(gatewayGroupKind, gatewayv1b1.GroupVersion.Version); err != nil {
+			if meta.IsNoMatchError(err) {
+				return fmt.Errorf("the Gateway API isn't installed in the cluster: %w", err)
+			}
+			return err
+		}
+	}
+
+	sourceCache, err := cache.New(mgr.GetConfig(), cache.Options{
+		Scheme:            mgr.GetScheme(),
+		Mapper:            mgr.GetRESTMapper(),
+		Namespace:         r.Source.name.Namespace,
+		SelectorsByObject: r.Source.cacheSelectors(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := mgr.Add(sourceCache); err != nil {
+		return err
+	}
+	r.Reader = sourceCache
+
+	c, err := controller.New(fmt.Sprintf("gateway-%s-%s-%s", strings.ToLower(r.Source.kind), r.Source.name.Namespace, r.Source.name.Name),
+		mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+	return c.Watch(source.NewKindWithCache(r.Source.newObject(), sourceCache), &handler.EnqueueRequestForObject{})
+}
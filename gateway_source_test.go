@@ -0,0 +1,77 @@
+package multicluster_gw
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	gatewayv1b1 "sigs.k8s.io/gateway-api/apis/v1beta1"
+)
+
+// TestGatewaySourceReconciler checks that the discovered gateway addresses follow the source resources.
+func TestGatewaySourceReconciler(t *testing.T) {
+	assert := require.New(t)
+	name := types.NamespacedName{Namespace: "gw-ns", Name: "gw"}
+	hostnameType := gatewayv1b1.HostnameAddressType
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: name.Namespace, Name: name.Name},
+		Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{
+			{IP: "6.6.6.6"}, {IP: "fd00::6"}, {Hostname: "lb.example.com"},
+		}}},
+	}
+	gateway := &gatewayv1b1.Gateway{
+		ObjectMeta: metav1.ObjectMeta{Namespace: name.Namespace, Name: name.Name},
+		Status: gatewayv1b1.GatewayStatus{Addresses: []gatewayv1b1.GatewayAddress{
+			{Value: "7.7.7.7"}, {Value: "6.6.6.6"}, {Type: &hostnameType, Value: "gw.example.com"},
+		}},
+	}
+	ctx := context.TODO()
+	req := reconcile.Request{NamespacedName: name}
+	pool := newGatewayPool()
+
+	client := getClient([]runtime.Object{service, gateway})
+	serviceReconciler := GatewaySourceReconciler{Reader: client, Source: gatewaySource{gatewaySourceService, name}, Gateway: pool}
+	gatewayReconciler := GatewaySourceReconciler{Reader: client, Source: gatewaySource{gatewaySourceGateway, name}, Gateway: pool}
+
+	_, err := serviceReconciler.Reconcile(ctx, req)
+	assert.Nil(err)
+	ip4, ip6 := pool.discoveredAddresses()
+	assert.Equal([]net.IP{net.IPv4(6, 6, 6, 6).To4()}, ip4)
+	assert.Equal([]net.IP{net.ParseIP("fd00::6")}, ip6)
+
+	// the addresses of both the sources, without duplicates:
+	_, err = gatewayReconciler.Reconcile(ctx, req)
+	assert.Nil(err)
+	ip4, _ = pool.discoveredAddresses()
+	assert.Equal([]net.IP{net.IPv4(7, 7, 7, 7).To4(), net.IPv4(6, 6, 6, 6).To4()}, ip4)
+
+	// a load balancer IP that changed:
+	service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "8.8.8.8"}}
+	assert.Nil(client.Status().Update(ctx, service))
+	_, err = serviceReconciler.Reconcile(ctx, req)
+	assert.Nil(err)
+	ip4, ip6 = pool.discoveredAddresses()
+	assert.Equal([]net.IP{net.IPv4(7, 7, 7, 7).To4(), net.IPv4(6, 6, 6, 6).To4(), net.IPv4(8, 8, 8, 8).To4()}, ip4)
+	assert.Empty(ip6)
+
+	// a deleted source has no addresses:
+	assert.Nil(client.Delete(ctx, gateway))
+	_, err = gatewayReconciler.Reconcile(ctx, req)
+	assert.Nil(err)
+	ip4, _ = pool.discoveredAddresses()
+	assert.Equal([]net.IP{net.IPv4(8, 8, 8, 8).To4()}, ip4)
+
+	// the source is cached by its name in its namespace:
+	for _, selector := range serviceReconciler.Source.cacheSelectors() {
+		assert.True(selector.Field.Matches(fields.Set{"metadata.namespace": name.Namespace, "metadata.name": name.Name}))
+		assert.False(selector.Field.Matches(fields.Set{"metadata.namespace": name.Namespace, "metadata.name": "other"}))
+		assert.False(selector.Field.Matches(fields.Set{"metadata.namespace": "other", "metadata.name": name.Name}))
+	}
+}
@@ -0,0 +1,51 @@
+package multicluster_gw
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestGatewayPoolPick checks which gateway addresses every policy answers with.
+func TestGatewayPoolPick(t *testing.T) {
+	ips := []net.IP{net.IPv4(6, 6, 6, 6).To4(), net.IPv4(7, 7, 7, 7).To4(), net.IPv4(8, 8, 8, 8).To4()}
+
+	pool := newGatewayPool()
+	assert.Equal(t, ips, pool.pick4(ips))
+	assert.Empty(t, pool.pick6(nil))
+
+	// round robin cycles over the addresses, one in every response:
+	pool.policy = policyRoundRobin
+	for i := 0; i < 2*len(ips); i++ {
+		assert.Equal(t, []net.IP{ips[i%len(ips)]}, pool.pick4(ips), "Response %d", i)
+	}
+
+	// a drained address is never answered:
+	pool.weights[ips[1].String()] = 0
+	for _, policy := range []string{policyAll, policyRoundRobin, policyRandom, policyWeighted} {
+		pool.policy = policy
+		for i := 0; i < 20; i++ {
+			picked := pool.pick4(ips)
+			assert.NotContains(t, picked, ips[1], "Policy %s", policy)
+			if policy != policyAll {
+				assert.Len(t, picked, 1, "Policy %s", policy)
+			}
+		}
+	}
+
+	// the weighted policy answers only by the weights:
+	pool.policy = policyWeighted
+	pool.weights[ips[0].String()] = 0
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, []net.IP{ips[2]}, pool.pick4(ips))
+	}
+
+	// if all the addresses are drained, they are still answered:
+	pool.weights[ips[2].String()] = 0
+	for i := 0; i < 20; i++ {
+		assert.Len(t, pool.pick4(ips), 1)
+	}
+	pool.policy = policyAll
+	assert.Equal(t, ips, pool.pick4(ips))
+}
@@ -0,0 +1,202 @@
+package multicluster_gw
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The modes of answering when all the gateway addresses are unhealthy.
+const (
+	allDownFallthrough = "fallthrough"  // pass the request to the next plugin
+	allDownServfail    = "servfail"     // answer SERVFAIL
+	allDownLastHealthy = "last_healthy" // answer the addresses that were the last ones to be healthy
+)
+
+const (
+	defaultHealthCheckInterval = 5 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+)
+
+// probeFunc checks if the gateway address is healthy, returning why it isn't if it isn't.
+type probeFunc func(ctx context.Context, ip net.IP) error
+
+// tcpProbe returns a probe that connects to the port of the address.
+func tcpProbe(port string) probeFunc {
+	return func(ctx context.Context, ip net.IP) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// httpProbe returns a probe that sends a GET request to the path in the port of the address,
+// expecting a 2xx or a 3xx status.
+func httpProbe(port string, path string) probeFunc {
+	client := &http.Client{
+		// a redirect may lead to another host, the gateway itself answered
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return func(ctx context.Context, ip net.IP) error {
+		url := "http://" + net.JoinHostPort(ip.String(), port) + path
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// healthChecker probes the gateway addresses every interval, and keeps which of them are healthy.
+// An address is healthy until its first probe failed.
+// Like the managers, it is hooked to the caddy lifecycle and runs only while the server runs.
+type healthChecker struct {
+	probe     probeFunc
+	addresses func() []net.IP // the addresses to probe
+	interval  time.Duration
+	timeout   time.Duration // of a single probe
+
+	mutex  sync.RWMutex
+	down   map[string]bool   // the addresses whose last probe failed, by their string form
+	lastUp map[string]uint64 // the last round in which every address was healthy
+	round  uint64            // the number of the probing rounds so far
+
+	runMutex sync.Mutex
+	cancel   context.CancelFunc
+	running  sync.WaitGroup
+}
+
+func newHealthChecker(probe probeFunc, addresses func() []net.IP) *healthChecker {
+	return &healthChecker{
+		probe:     probe,
+		addresses: addresses,
+		interval:  defaultHealthCheckInterval,
+		timeout:   defaultHealthCheckTimeout,
+		down:      make(map[string]bool),
+		lastUp:    make(map[string]uint64),
+	}
+}
+
+// Start starts probing in the background, if it isn't running already.
+func (hc *healthChecker) Start() error {
+	hc.runMutex.Lock()
+	defer hc.runMutex.Unlock()
+	if hc.cancel != nil {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	hc.cancel = cancel
+	hc.running.Add(1)
+	go func() {
+		defer hc.running.Done()
+		ticker := time.NewTicker(hc.interval)
+		defer ticker.Stop()
+		for {
+			hc.probeAll(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops probing, and waits for the running probes. Stopping when not running does nothing.
+func (hc *healthChecker) Stop() error {
+	hc.runMutex.Lock()
+	defer hc.runMutex.Unlock()
+	if hc.cancel == nil {
+		return nil
+	}
+	hc.cancel()
+	hc.running.Wait()
+	hc.cancel = nil
+	return nil
+}
+
+// probeAll probes all the addresses at once, and updates their health by the results.
+func (hc *healthChecker) probeAll(ctx context.Context) {
+	addresses := hc.addresses()
+	errs := make([]error, len(addresses))
+	var probes sync.WaitGroup
+	for i, ip := range addresses {
+		probes.Add(1)
+		go func(i int, ip net.IP) {
+			defer probes.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, hc.timeout)
+			defer cancel()
+			errs[i] = hc.probe(probeCtx, ip)
+		}(i, ip)
+	}
+	probes.Wait()
+	if ctx.Err() != nil {
+		// stopped in the middle of the round, the results are of the cancellation
+		return
+	}
+
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	hc.round++
+	for i, ip := range addresses {
+		key := ip.String()
+		if errs[i] != nil {
+			if !hc.down[key] {
+				log.Warningf("Gateway %s is unhealthy: %v", key, errs[i])
+			}
+			hc.down[key] = true
+			continue
+		}
+		if hc.down[key] {
+			log.Infof("Gateway %s is healthy again", key)
+		}
+		delete(hc.down, key)
+		hc.lastUp[key] = hc.round
+	}
+}
+
+// healthy returns the healthy ones of the addresses.
+func (hc *healthChecker) healthy(ips []net.IP) []net.IP {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+	healthy := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if !hc.down[ip.String()] {
+			healthy = append(healthy, ip)
+		}
+	}
+	return healthy
+}
+
+// lastHealthy returns the ones of the addresses that were healthy the most recently.
+func (hc *healthChecker) lastHealthy(ips []net.IP) []net.IP {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+	var last []net.IP
+	var lastRound uint64
+	for _, ip := range ips {
+		round := hc.lastUp[ip.String()]
+		switch {
+		case round > lastRound:
+			last, lastRound = []net.IP{ip}, round
+		case round == lastRound:
+			last = append(last, ip)
+		}
+	}
+	return last
+}
@@ -0,0 +1,99 @@
+package multicluster_gw
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHealthCheckerProbeAll checks that the health of the addresses follows their probes.
+func TestHealthCheckerProbeAll(t *testing.T) {
+	ips := []net.IP{net.IPv4(6, 6, 6, 6).To4(), net.IPv4(7, 7, 7, 7).To4()}
+	up := map[string]bool{"6.6.6.6": true, "7.7.7.7": true}
+	hc := newHealthChecker(func(_ context.Context, ip net.IP) error {
+		if !up[ip.String()] {
+			return errors.New("down")
+		}
+		return nil
+	}, func() []net.IP { return ips })
+	ctx := context.Background()
+
+	// healthy before they were probed:
+	assert.Equal(t, ips, hc.healthy(ips))
+
+	hc.probeAll(ctx)
+	assert.Equal(t, ips, hc.healthy(ips))
+
+	up["6.6.6.6"] = false
+	hc.probeAll(ctx)
+	assert.Equal(t, ips[1:], hc.healthy(ips))
+
+	up["7.7.7.7"] = false
+	hc.probeAll(ctx)
+	assert.Empty(t, hc.healthy(ips))
+	assert.Equal(t, ips[1:], hc.lastHealthy(ips))
+
+	// recovers:
+	up["6.6.6.6"] = true
+	hc.probeAll(ctx)
+	assert.Equal(t, ips[:1], hc.healthy(ips))
+	assert.Equal(t, ips[:1], hc.lastHealthy(ips))
+
+	// a stopped round doesn't change the health:
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	up["6.6.6.6"] = false
+	hc.probeAll(canceled)
+	assert.Equal(t, ips[:1], hc.healthy(ips))
+}
+
+// TestHealthCheckerLifecycle checks that the caddy hooks can be called repeatedly, as happens on reload.
+func TestHealthCheckerLifecycle(t *testing.T) {
+	assert := require.New(t)
+	probed := make(chan struct{}, 1)
+	hc := newHealthChecker(func(context.Context, net.IP) error {
+		select {
+		case probed <- struct{}{}:
+		default:
+		}
+		return nil
+	}, func() []net.IP { return []net.IP{defaultGwIpv4} })
+
+	assert.Nil(hc.Stop())
+	assert.Nil(hc.Start())
+	assert.Nil(hc.Start())
+	<-probed
+	assert.Nil(hc.Stop())
+	assert.Nil(hc.cancel)
+	assert.Nil(hc.Stop())
+}
+
+// TestProbes checks the tcp and http probes against local servers.
+func TestProbes(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	ctx := context.Background()
+	localhost := net.IPv4(127, 0, 0, 1)
+
+	assert.Nil(t, tcpProbe(port)(ctx, localhost))
+	listener.Close()
+	assert.NotNil(t, tcpProbe(port)(ctx, localhost))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	_, port, _ = net.SplitHostPort(server.Listener.Addr().String())
+
+	assert.Nil(t, httpProbe(port, "/healthz")(ctx, localhost))
+	assert.NotNil(t, httpProbe(port, "/")(ctx, localhost))
+}
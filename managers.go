@@ -0,0 +1,276 @@
+package multicluster_gw
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	mcsv1a1 "sigs.k8s.io/mcs-api/pkg/apis/v1alpha1"
+)
+
+// managerRetryInterval is the interval of retrying to build the manager of a cluster.
+const managerRetryInterval = 10 * time.Second
+
+// clusterManagers runs the controller managers of a plugin instance, one for every watched cluster.
+// It is hooked to the caddy lifecycle: the managers are started on startup and stopped on
+// shutdown/restart, so a reload of the corefile doesn't leave old managers running behind.
+// A controller-runtime manager can be started only once, so new managers are built on every start.
+// They are built in the background, so a cluster whose API server is down doesn't fail the startup.
+type clusterManagers struct {
+	clusters    []Cluster
+	store       *Store
+	syncTimeout time.Duration // 0 means waiting for the sync without a timeout
+	syncFail    bool          // fail the startup if the clusters didn't sync in syncTimeout, instead of going degraded
+
+	gatewaySources    []gatewaySource // watched in the first cluster, reported to gateway
+	gateway           *gatewayPool
+	namespaceGateways *namespaceGateways // the Namespaces of the first cluster that match its selectors are reported to it, if set
+	stale             *staleTracker      // the clusters report the loss of their API server connections to it, if set
+
+	mutex   sync.Mutex
+	cancel  context.CancelFunc
+	running sync.WaitGroup // the running managers
+
+	syncMutex sync.Mutex
+	synced    map[string]void // the clusters whose ServiceImports were loaded to the store
+	allSynced chan struct{}   // closed once all the clusters synced
+	degraded  int32           // set (atomically) when we went ready without all the clusters synced
+}
+
+func newClusterManagers(clusters []Cluster, store *Store) *clusterManagers {
+	cm := &clusterManagers{
+		clusters:  clusters,
+		store:     store,
+		synced:    make(map[string]void),
+		allSynced: make(chan struct{}),
+	}
+	if len(clusters) == 0 {
+		close(cm.allSynced)
+	}
+	return cm
+}
+
+// checkConfigs loads the client configs of all the clusters, without connecting to them.
+// It is called on setup, so a bad kubeconfig fails the setup, while clusters that can't be reached don't.
+func (cm *clusterManagers) checkConfigs() error {
+	for _, cluster := range cm.clusters {
+		if _, err := cluster.getClientConfig(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildManager creates the manager of the cluster, without starting it. Creating a manager needs the
+// API server of the cluster, to discover its resources.
+func (cm *clusterManagers) buildManager(i int) (manager.Manager, error) {
+	mgr, err := cm.clusters[i].newManager(cm.store, cm.stale)
+	if err != nil || i > 0 {
+		return mgr, err
+	}
+	for _, source := range cm.gatewaySources {
+		// the gateway sources are in the first cluster, the one the plugin is usually running in
+		if err := (&GatewaySourceReconciler{
+			Source:  source,
+			Gateway: cm.gateway,
+		}).SetupWithManager(mgr); err != nil {
+			return nil, fmt.Errorf("unable to create the controller of the gateway source %s: %w", source, err)
+		}
+	}
+	if cm.namespaceGateways != nil {
+		for j, gateway := range cm.namespaceGateways.gateways {
+			if gateway.selector == nil {
+				continue
+			}
+			if err := (&NamespaceReconciler{
+				Gateways: cm.namespaceGateways,
+				Gateway:  j,
+			}).SetupWithManager(mgr); err != nil {
+				return nil, fmt.Errorf("unable to create the Namespace controller of the selector '%s': %w", gateway.selector, err)
+			}
+		}
+	}
+	return mgr, nil
+}
+
+// Start starts the managers of all the clusters. Starting managers that already run does nothing.
+// If a sync timeout is configured, either waits for the clusters to sync (and fails if they don't),
+// or lets the plugin go ready in degraded mode once the timeout passes.
+func (cm *clusterManagers) Start() error {
+	cm.start()
+	if cm.syncTimeout == 0 {
+		return nil
+	}
+
+	if cm.syncFail {
+		if !cm.waitForSync(cm.syncTimeout) {
+			cm.Stop()
+			return fmt.Errorf("the ServiceImports of all the clusters weren't synced within %v", cm.syncTimeout)
+		}
+		return nil
+	}
+	go func() {
+		if !cm.waitForSync(cm.syncTimeout) {
+			log.Warningf("The ServiceImports of all the clusters weren't synced within %v, going ready in degraded mode", cm.syncTimeout)
+			atomic.StoreInt32(&cm.degraded, 1)
+		}
+	}()
+	return nil
+}
+
+func (cm *clusterManagers) start() {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	if cm.cancel != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cm.cancel = cancel
+	if cm.stale != nil {
+		cm.stale.resume()
+	}
+	for i := range cm.clusters {
+		go cm.runCluster(ctx, i)
+	}
+}
+
+// runCluster builds the manager of the cluster and starts it. While the manager can't be built (the API server
+// can't be reached) the cluster is marked as lost, and the build is retried until the managers stop.
+func (cm *clusterManagers) runCluster(ctx context.Context, i int) {
+	cluster := cm.clusters[i].Name
+	for {
+		mgr, err := cm.buildManager(i)
+
+		// Stop doesn't wait for the builds, only for the managers that were started:
+		cm.mutex.Lock()
+		if ctx.Err() != nil {
+			cm.mutex.Unlock()
+			return
+		}
+		if err == nil {
+			setupLog.Info("starting manager", "cluster", cluster)
+			cm.running.Add(2)
+			go cm.activateManager(ctx, cluster, mgr)
+			go cm.syncCluster(ctx, cluster, mgr)
+			cm.mutex.Unlock()
+			return
+		}
+		if cm.stale != nil {
+			cm.stale.lose(cluster, err)
+		}
+		cm.mutex.Unlock()
+
+		setupLog.Error(err, "unable to build manager, retrying", "cluster", cluster, "interval", managerRetryInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(managerRetryInterval):
+		}
+	}
+}
+
+// Stop stops the running managers and waits for them to return. Stopping stopped managers does nothing.
+func (cm *clusterManagers) Stop() error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	if cm.cancel == nil {
+		return nil
+	}
+	cm.cancel()
+	cm.running.Wait()
+	cm.cancel = nil
+	if cm.stale != nil {
+		cm.stale.pause()
+	}
+	setupLog.Info("stopped managers")
+	return nil
+}
+
+// fucntion to activate the manager, splitted to a different func to do in a seperate go routine
+func (cm *clusterManagers) activateManager(ctx context.Context, cluster string, mgr manager.Manager) {
+	defer cm.running.Done()
+	if err := mgr.Start(ctx); err != nil {
+		setupLog.Error(err, "problem running manager", "cluster", cluster)
+	}
+}
+
+// syncCluster waits for the cache of the cluster to sync, and loads all its ServiceImports to the store
+// before marking the cluster as synced. This way we don't go ready before the reconciler got to all of them.
+func (cm *clusterManagers) syncCluster(ctx context.Context, cluster string, mgr manager.Manager) {
+	defer cm.running.Done()
+	if !mgr.GetCache().WaitForCacheSync(ctx) {
+		// the manager was stopped before the cache synced
+		return
+	}
+
+	siList := &mcsv1a1.ServiceImportList{}
+	if err := mgr.GetClient().List(ctx, siList); err != nil {
+		setupLog.Error(err, "Failed to list ServiceImports", "cluster", cluster)
+		return
+	}
+	// load them the same way the reconciler does:
+	r := &ServiceImportReconciler{
+		Client:      mgr.GetClient(),
+		Scheme:      mgr.GetScheme(),
+		ClusterName: cluster,
+		Store:       cm.store,
+	}
+	failed := make(map[types.NamespacedName]void)
+	for _, si := range siList.Items {
+		req := reconcile.Request{NamespacedName: types.NamespacedName{Name: si.Name, Namespace: si.Namespace}}
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			// the controller retries it, no reason to hold the readiness for it
+			setupLog.Error(err, "Failed to load ServiceImport", "cluster", cluster, "serviceimport", req.NamespacedName)
+			failed[req.NamespacedName] = member
+		}
+	}
+	// what the cluster had in the snapshot and doesn't have anymore. The ones that failed to load are still in
+	// the cluster, they stay stale until the controller loads them:
+	if deleted := cm.store.DeleteStale(cluster, failed); deleted > 0 {
+		log.Infof("Removed %d ServiceImports of cluster '%s' that were only in the snapshot", deleted, cluster)
+	}
+	cm.markSynced(cluster)
+}
+
+// markSynced marks that the ServiceImports of the cluster were loaded to the store.
+func (cm *clusterManagers) markSynced(cluster string) {
+	cm.syncMutex.Lock()
+	defer cm.syncMutex.Unlock()
+	if _, exists := cm.synced[cluster]; exists {
+		return
+	}
+	cm.synced[cluster] = member
+	log.Infof("ServiceImports of cluster '%s' synced", cluster)
+	if len(cm.synced) == len(cm.clusters) {
+		close(cm.allSynced)
+	}
+}
+
+// waitForSync waits up to timeout for all the clusters to sync, and returns if they did.
+func (cm *clusterManagers) waitForSync(timeout time.Duration) bool {
+	select {
+	case <-cm.allSynced:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Ready returns true once all the clusters synced, or the sync timeout passed in degraded mode.
+func (cm *clusterManagers) Ready() bool {
+	if atomic.LoadInt32(&cm.degraded) == 1 {
+		return true
+	}
+	select {
+	case <-cm.allSynced:
+		return true
+	default:
+		return false
+	}
+}
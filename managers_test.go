@@ -0,0 +1,74 @@
+package multicluster_gw
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// TestClusterManagersLifecycle checks that the caddy hooks can be called repeatedly, as happens on reload.
+func TestClusterManagersLifecycle(t *testing.T) {
+	assert := require.New(t)
+	cm := newClusterManagers(nil, NewStore())
+
+	assert.Nil(cm.checkConfigs())
+	assert.Nil(cm.Stop()) // stop before start (restart that happens before the startup)
+	assert.Nil(cm.Start())
+	assert.NotNil(cm.cancel)
+	assert.Nil(cm.Start()) // already running
+	assert.Nil(cm.Stop())
+	assert.Nil(cm.cancel)
+	assert.Nil(cm.Stop())  // shutdown after restart
+	assert.Nil(cm.Start()) // restart failed, start again
+	assert.Nil(cm.Stop())
+}
+
+// TestClusterManagersUnreachable checks that a cluster whose API server can't be reached doesn't fail the startup,
+// and is marked as lost until it is, also after a failed reload.
+func TestClusterManagersUnreachable(t *testing.T) {
+	assert := require.New(t)
+	config := clientcmdapi.Config{
+		Clusters:       map[string]*clientcmdapi.Cluster{"down": {Server: "https://127.0.0.1:1"}},
+		Contexts:       map[string]*clientcmdapi.Context{"down": {Cluster: "down"}},
+		CurrentContext: "down",
+	}
+	cm := newClusterManagers([]Cluster{{Name: cluster1, ClientConfig: clientcmd.NewDefaultClientConfig(config, &clientcmd.ConfigOverrides{})}}, NewStore())
+	cm.stale = newStaleTracker()
+
+	assert.Nil(cm.checkConfigs())
+	assert.Nil(cm.Start())
+	assert.Eventually(func() bool { return cm.stale.isLost(cluster1) }, 10*time.Second, 10*time.Millisecond)
+	assert.False(cm.Ready())
+
+	// the reload failed, the old managers start again:
+	assert.Nil(cm.Stop())
+	assert.True(cm.stale.isLost(cluster1))
+	assert.Nil(cm.Start())
+	assert.True(cm.stale.isLost(cluster1))
+	assert.Nil(cm.Stop())
+}
+
+// TestClusterManagersReady checks that we go ready only once all the clusters synced.
+func TestClusterManagersReady(t *testing.T) {
+	assert := require.New(t)
+	cm := newClusterManagers([]Cluster{{Name: cluster1}, {Name: cluster2}}, NewStore())
+
+	assert.False(cm.Ready())
+	cm.markSynced(cluster1)
+	assert.False(cm.Ready())
+	assert.False(cm.waitForSync(10 * time.Millisecond))
+
+	cm.markSynced(cluster2)
+	assert.True(cm.Ready())
+	assert.True(cm.waitForSync(10 * time.Millisecond))
+	cm.markSynced(cluster2) // a cluster that synced again after a restart
+	assert.True(cm.Ready())
+
+	mcgw := MulticlusterGw{managers: newClusterManagers([]Cluster{{Name: cluster1}}, NewStore())}
+	assert.False(mcgw.Ready())
+	mcgw.managers.markSynced(cluster1)
+	assert.True(mcgw.Ready())
+}
@@ -3,31 +3,46 @@ package multicluster_gw
 import (
 	"context"
 	"errors"
-	"fmt"
 	"net"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/coredns/coredns/plugin"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
 	"github.com/coredns/coredns/plugin/pkg/fall"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
-	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/apimachinery/pkg/types"
+	mcsv1a1 "sigs.k8s.io/mcs-api/pkg/apis/v1alpha1"
 )
 
 const (
-	// defaultTTL to apply to all answers.
-	// #TODO maybe add it to the core-config?
+	// defaultTTL to apply to all answers, unless the ttl directive sets another one.
 	defaultTTL = 5
+	// maxTTL is the maximum TTL the ttl directives and annotation accept.
+	maxTTL = 3600
+	// nsName is the name of the name server of the zones, under every zone (ns.dns.svc.clusterset.local.)
+	nsName = "ns.dns."
+	// maxPTRRecords is the most PTR records an address is answered with, as many ServiceImports may share it.
+	maxPTRRecords = 20
 )
 
 var (
-	errNoItems        = errors.New("no items found")
-	errNsNotExposed   = errors.New("namespace is not exposed")
-	errInvalidRequest = errors.New("invalid query name")
-	defaultGwIpv4     = net.IPv4(1, 2, 3, 4)
-	defaultGwIpv6     = net.IPv4(1, 2, 3, 4).To16()
+	errNoItems          = errors.New("no items found")
+	errNsNotExposed     = errors.New("namespace is not exposed")
+	errInvalidRequest   = errors.New("invalid query name")
+	errMalformedRequest = errors.New("malformed query name")
+	errGatewaysDown     = errors.New("all the gateway addresses are unhealthy")
+	defaultGwIpv4       = net.IPv4(1, 2, 3, 4).To4()
+)
+
+// The values of the answer mode annotation of a ServiceImport.
+const (
+	answerGateway      = "gateway"
+	answerClusterSetIP = "clusterset-ip"
 )
 
 // Define log to be a logger with the plugin name in it.
@@ -35,31 +50,91 @@ var log = clog.NewWithPlugin(pluginName)
 
 // MulticlusterGw implements a plugin supporting multi-cluster DNS spec using a gateway.
 type MulticlusterGw struct {
-	Next         plugin.Handler
-	Zones        []string
-	Fall         fall.F
-	ClientConfig clientcmd.ClientConfig
-	gatewayIp4   net.IP
-	gatewayIp6   net.IP
-	svcName      string
-	svcNS        string
-	ttl          uint32
-	SISet        Set
+	Next        plugin.Handler
+	Zones       []string
+	Fall        fall.F
+	Clusters    []Cluster
+	gatewayIp4  []net.IP // the configured gateway addresses, the discovered ones are in the gateway pool
+	gatewayIp6  []net.IP // only real IPv6 addresses, AAAA requests get NODATA if there are none
+	gateway     *gatewayPool
+	ttl         uint32 // the TTL of the answers
+	negativeTTL uint32 // the TTL of the negative answers (the minimum TTL of the SOA)
+	Store       *Store
+	managers    *clusterManagers
+
+	clusterSetIPZones    []string           // the zones in which the ClusterSetIPs are answered instead of the gateway
+	gatewayHostname      string             // the name reverse lookups of the gateway address point to, if set
+	gatewayHost          string             // the name of the gateway, if it is given by name instead of by addresses
+	gatewayHostFlatten   bool               // answer the addresses of gatewayHost instead of a CNAME to it
+	gatewayHostUpstreams []string           // the servers (host:port) to resolve gatewayHost with, the server itself if none
+	gatewayHostCache     *gatewayHostCache  // the addresses gatewayHost was resolved to, when flattened
+	gatewaySources       []gatewaySource    // the resources the gateway addresses are discovered from
+	namespaceGateways    *namespaceGateways // the gateways of the namespaces that have their own
+
+	syncTimeout time.Duration // how long to wait for the clusters to sync before giving up
+	syncFail    bool          // fail the startup on sync timeout instead of going ready degraded
+
+	snapshotFile     string        // the file the store is persisted to, and loaded from on startup, if set
+	snapshotInterval time.Duration // how often the store is written to snapshotFile
+
+	stale     *staleTracker // the clusters whose API server connection is lost
+	maxStale  time.Duration // how long to answer from the last known state when a connection is lost, no limit if 0
+	staleMode string        // how to answer after maxStale
 }
 
 func (mcgw *MulticlusterGw) New(zones []string) {
 	mcgw.Zones = zones
 	// set default gateway:
-	mcgw.gatewayIp4 = defaultGwIpv4
-	mcgw.gatewayIp6 = defaultGwIpv6
+	mcgw.gatewayIp4 = []net.IP{defaultGwIpv4}
+	mcgw.gatewayIp6 = nil
+	mcgw.gateway = newGatewayPool()
+	mcgw.gatewayHostCache = newGatewayHostCache()
+	mcgw.stale = newStaleTracker()
+	mcgw.staleMode = staleServfail
+	mcgw.namespaceGateways = newNamespaceGateways()
 	mcgw.ttl = defaultTTL
+	mcgw.negativeTTL = defaultTTL
+}
+
+// gatewayIPs returns the IPv4 and the IPv6 addresses of the gateway: the configured ones,
+// and the ones discovered from the gateway sources.
+func (m MulticlusterGw) gatewayIPs() ([]net.IP, []net.IP) {
+	discovered4, discovered6 := m.gateway.discoveredAddresses()
+	return mergeIPs(m.gatewayIp4, discovered4), mergeIPs(m.gatewayIp6, discovered6)
+}
+
+// mergeIPs returns the ips, followed by the others that aren't in them.
+func mergeIPs(ips []net.IP, others []net.IP) []net.IP {
+	if len(others) == 0 {
+		return ips
+	}
+	merged := append([]net.IP{}, ips...)
+	for _, ip := range others {
+		if !containsIP(merged, ip) {
+			merged = append(merged, ip)
+		}
+	}
+	return merged
+}
+
+// gatewayAddresses returns all the addresses of the gateway, of both families.
+func (m *MulticlusterGw) gatewayAddresses() []net.IP {
+	ip4, ip6 := m.gatewayIPs()
+	addresses := make([]net.IP, 0, len(ip4)+len(ip6))
+	addresses = append(addresses, ip4...)
+	return append(addresses, ip6...)
+}
+
+// probedAddresses returns the addresses that are health checked: the addresses of the gateway,
+// and of the gateways of the namespaces.
+func (m *MulticlusterGw) probedAddresses() []net.IP {
+	return mergeIPs(m.gatewayAddresses(), m.namespaceGateways.addresses())
 }
 
 // ServeDNS implements the plugin.Handler interface.
 func (m MulticlusterGw) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	// Debug log that we've have seen the query.
 	log.Debug("gw_mcs received req")
-	fmt.Print("check output")
 	// parse the req:
 	state := request.Request{W: w, Req: r}
 
@@ -78,38 +153,47 @@ func (m MulticlusterGw) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *d
 	zone = qname[len(qname)-len(zone):]
 	state.Zone = zone
 
-	m.svcName, m.svcNS = parseReqNameNs(qname[:len(qname)-len(zone)])
-
-	var records []dns.RR
-
-	// checks if the SI exists:
-	if Mcgw.SISet.Contains(GenerateNameAsString(m.svcName, m.svcNS)) {
-		switch state.QType() {
-		case dns.TypeA:
-			log.Debug("Handles Type A request")
-			records = append(records, NewARecord(qname, m.gatewayIp4))
-		case dns.TypeAAAA:
-			log.Debug("Handles Type AAAA request")
-			records = append(records, NewAAAARecord(qname, m.gatewayIp6))
-
-		default:
-			// TODO: check which error I should return if the req type dosent match
-
-			if m.Fall.Through(state.Name()) {
-				return plugin.NextOrFailure(m.Name(), m.Next, ctx, w, r)
-			}
-			return dns.RcodeNameError, nil // return NXDomain
+	records, extra, entry, err := m.records(ctx, state, qname[:len(qname)-len(zone)])
+	stale, expired := m.staleness(entry)
+	if expired {
+		switch m.staleMode {
+		case staleFallthrough:
+			return plugin.NextOrFailure(m.Name(), m.Next, ctx, w, r)
+		case staleServfail:
+			log.Debugf("The answer of %s is stale for longer than max_stale", qname)
+			message := &dns.Msg{}
+			message.SetRcode(r, dns.RcodeServerFailure)
+			w.WriteMsg(message)
+			return dns.RcodeSuccess, nil
 		}
-
-	} else {
-
-		// The service export dosent exists, try fallthrough(?)
-		// return NODATA error (?)
-		log.Debug("Didn't find the SI in the SIset")
+	}
+	if err == errMalformedRequest {
+		log.Debugf("Malformed query name %s", qname)
+		message := &dns.Msg{}
+		message.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(message)
+		return dns.RcodeSuccess, nil
+	}
+	if err == errGatewaysDown {
+		if m.gateway.allDown == allDownFallthrough {
+			return plugin.NextOrFailure(m.Name(), m.Next, ctx, w, r)
+		}
+		log.Debugf("No healthy gateway to answer %s with", qname)
+		message := &dns.Msg{}
+		message.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(message)
+		return dns.RcodeSuccess, nil
+	}
+	if m.IsNameError(err) {
+		// The name dosent exists, try fallthrough, or return NXDOMAIN
 		if m.Fall.Through(state.Name()) {
 			return plugin.NextOrFailure(m.Name(), m.Next, ctx, w, r)
 		}
-		return dns.RcodeNameError, nil // return NXDomain
+		return m.writeNegative(state, dns.RcodeNameError, stale)
+	}
+	if len(records) == 0 {
+		// The name exists, but has no records of the requested type - NODATA
+		return m.writeNegative(state, dns.RcodeSuccess, stale)
 	}
 
 	// if the req succeed:
@@ -119,10 +203,237 @@ func (m MulticlusterGw) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *d
 
 	//Add the answer:
 	message.Answer = append(message.Answer, records...)
+	message.Extra = append(message.Extra, extra...)
+	if stale {
+		markStale(message, r)
+	}
 	w.WriteMsg(message)
 	return dns.RcodeSuccess, nil
 }
 
+// records returns the answer and the extra records for the request, that was trimmed from the zone,
+// and the ServiceImport they are of, if the name is of one (nil for the apex, the reverse zones and the namespaces).
+// If the requested name doesn't exist, errNoItems is returned. If it exists, but has no
+// records of the requested type, no records are returned (NODATA).
+func (m MulticlusterGw) records(ctx context.Context, state request.Request, qnameTrimmed string) ([]dns.RR, []dns.RR, *ServiceImportEntry, error) {
+	// the zone itself, and the name of its name server:
+	if qnameTrimmed == "" {
+		records, extra, err := m.apexRecords(state)
+		return records, extra, nil, err
+	}
+	// the name server is advertised in the reverse zones too:
+	if strings.EqualFold(qnameTrimmed, nsName) {
+		return m.nsAddressRecords(state, state.QName(), state.QType()), nil, nil, nil
+	}
+	if dnsutil.IsReverse(state.Zone) > 0 {
+		records, extra, err := m.reverseRecords(state)
+		return records, extra, nil, err
+	}
+
+	req, err := parseRequest(qnameTrimmed)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if req.service == "" {
+		// only the namespace - it exists if any SI exists in it:
+		if !m.namespaceExists(req.namespace) {
+			return nil, nil, nil, errNsNotExposed
+		}
+		return nil, nil, nil, nil
+	}
+
+	// checks if the SI exists:
+	entry, exists := m.Store.Get(types.NamespacedName{Namespace: req.namespace, Name: req.service})
+	if !exists {
+		log.Debug("Didn't find the SI in the store")
+		return nil, nil, nil, errNoItems
+	}
+	records, extra, err := m.serviceImportRecords(ctx, state, req, entry.ServiceImportInfo)
+	return records, extra, &entry, err
+}
+
+// serviceImportRecords returns the answer and the extra records for a request of the ServiceImport.
+func (m MulticlusterGw) serviceImportRecords(ctx context.Context, state request.Request, req recordRequest, siInfo ServiceImportInfo) ([]dns.RR, []dns.RR, error) {
+	qname := state.QName()
+	if req.cluster != "" {
+		// only the endpoints of a headless SI have names:
+		siInfo.Endpoints = siInfo.endpointsOf(req.cluster, req.hostname)
+		if siInfo.Type != mcsv1a1.Headless || len(siInfo.Endpoints) == 0 {
+			return nil, nil, errNoItems
+		}
+	}
+	if req.port != "" {
+		siPort, found := siInfo.findPort(req.port, req.protocol)
+		if !found {
+			log.Debug("Didn't find the requested port of the SI")
+			return nil, nil, errNoItems
+		}
+		siInfo.Ports = []mcsv1a1.ServicePort{siPort}
+		if state.QType() != dns.TypeSRV {
+			// the name of the port has only SRV records
+			return nil, nil, nil
+		}
+	}
+
+	if m.gatewayHost != "" && state.QType() != dns.TypeSRV {
+		if _, _, source := m.addressesOf(state.Name(), req.namespace, siInfo); source == fromPluginGateway {
+			// the gateway is a name, the SI is an alias of it:
+			return m.gatewayHostRecords(ctx, state, m.ttlOf(siInfo)), nil, nil
+		}
+	}
+
+	switch state.QType() {
+	case dns.TypeSRV:
+		log.Debug("Handles Type SRV request")
+		return m.srvRecords(state.Name(), qname, req.serviceName(state.Zone), req.namespace, siInfo)
+	case dns.TypeA:
+		log.Debug("Handles Type A request")
+		ip4, _, err := m.answerIPs(state.Name(), req.namespace, siInfo, dns.TypeA)
+		return newARecords(qname, ip4, m.ttlOf(siInfo)), nil, err
+	case dns.TypeAAAA:
+		log.Debug("Handles Type AAAA request")
+		_, ip6, err := m.answerIPs(state.Name(), req.namespace, siInfo, dns.TypeAAAA)
+		return newAAAARecords(qname, ip6, m.ttlOf(siInfo)), nil, err
+	}
+	return nil, nil, nil
+}
+
+// namespaceExists returns if any SI exists in the namespace.
+func (m MulticlusterGw) namespaceExists(namespace string) bool {
+	return m.Store.HasNamespace(namespace)
+}
+
+// reverseRecords returns the PTR records of an address in a reverse zone.
+// The gateway address points to the configured gateway hostname if there is one. Otherwise, an address
+// points to the names of the ServiceImports that resolve to it by the store's address index (their ClusterSetIPs
+// or their own gateway), and to the names of the endpoints of headless ServiceImports, up to maxPTRRecords of them.
+func (m MulticlusterGw) reverseRecords(state request.Request) ([]dns.RR, []dns.RR, error) {
+	ip := net.ParseIP(dnsutil.ExtractAddressFromReverse(state.Name()))
+	zone := m.forwardZone()
+	if ip == nil || zone == "" {
+		return nil, nil, errNoItems
+	}
+
+	var targets []string
+	if m.gatewayHostname != "" && containsIP(m.gatewayAddresses(), ip) {
+		targets = append(targets, m.gatewayHostname)
+	} else {
+		// the ServiceImports that have the address themselves: as a ClusterSetIP, the address of an endpoint
+		// or of their own gateway. The ServiceImports answered with a shared gateway aren't listed by it.
+		for _, entry := range m.Store.ByAddress(ip) {
+			svcTarget := entry.Name.Name + "." + entry.Name.Namespace + "." + zone
+			if entry.Type == mcsv1a1.Headless {
+				for _, endpoint := range entry.Endpoints {
+					if endpoint.Hostname != "" && containsIP(endpoint.IPs, ip) {
+						targets = append(targets, endpoint.Hostname+"."+endpoint.ClusterID+"."+svcTarget)
+					}
+				}
+				continue
+			}
+			ip4, ip6, _ := m.addressesOf(svcTarget, entry.Name.Namespace, entry.ServiceImportInfo)
+			if containsIP(ip4, ip) || containsIP(ip6, ip) {
+				targets = append(targets, svcTarget)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return nil, nil, errNoItems
+	}
+	if state.QType() != dns.TypePTR {
+		return nil, nil, nil
+	}
+
+	sort.Strings(targets)
+	if len(targets) > maxPTRRecords {
+		targets = targets[:maxPTRRecords]
+	}
+	records := make([]dns.RR, 0, len(targets))
+	for _, target := range targets {
+		records = append(records, NewPTRRecord(state.QName(), target, m.ttl))
+	}
+	return records, nil, nil
+}
+
+// forwardZone returns the first zone of the plugin that isn't a reverse zone, which is the
+// zone of the names in the PTR records. Empty if there is no such zone.
+func (m MulticlusterGw) forwardZone() string {
+	for _, zone := range m.Zones {
+		if dnsutil.IsReverse(zone) == 0 {
+			return zone
+		}
+	}
+	return ""
+}
+
+// apexRecords returns the records of the zone apex: its SOA and NS, each for its type.
+// The glue records of the name server are returned as extra in NS requests.
+func (m MulticlusterGw) apexRecords(state request.Request) ([]dns.RR, []dns.RR, error) {
+	switch state.QType() {
+	case dns.TypeSOA:
+		return []dns.RR{m.soa(state.Zone)}, nil, nil
+	case dns.TypeNS:
+		ns := m.ns(state.Zone)
+		extra := m.nsAddressRecords(state, ns.Ns, dns.TypeA)
+		extra = append(extra, m.nsAddressRecords(state, ns.Ns, dns.TypeAAAA)...)
+		return []dns.RR{ns}, extra, nil
+	}
+	return nil, nil, nil
+}
+
+// nsAddressRecords returns the address records of the given type, of the name server of the zone.
+// Its address is the local address the request was received on.
+func (m MulticlusterGw) nsAddressRecords(state request.Request, name string, qtype uint16) []dns.RR {
+	ip := net.ParseIP(state.LocalIP())
+	if ip == nil {
+		return nil
+	}
+	switch {
+	case qtype == dns.TypeA && ip.To4() != nil:
+		return []dns.RR{NewARecord(name, ip.To4(), m.ttl)}
+	case qtype == dns.TypeAAAA && ip.To4() == nil:
+		return []dns.RR{NewAAAARecord(name, ip, m.ttl)}
+	}
+	return nil
+}
+
+// writeNegative writes a negative answer (NXDOMAIN or NODATA, by the rcode) with the SOA of the zone
+// in the authority section, so resolvers can cache the answer (RFC 2308). A stale answer is marked as one.
+func (m MulticlusterGw) writeNegative(state request.Request, rcode int, stale bool) (int, error) {
+	message := &dns.Msg{}
+	message.SetRcode(state.Req, rcode)
+	message.Authoritative = true
+	// the negative answer is cached for the TTL of the SOA (RFC 2308), which is the negative TTL
+	soa := m.soa(state.Zone)
+	soa.Hdr.Ttl = m.negativeTTL
+	message.Ns = []dns.RR{soa}
+	if stale {
+		markStale(message, state.Req)
+	}
+	state.W.WriteMsg(message)
+	// Return success as the rcode to signal we have written to the client.
+	return dns.RcodeSuccess, nil
+}
+
+// ns returns the NS record of the zone.
+func (m MulticlusterGw) ns(zone string) *dns.NS {
+	return &dns.NS{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: m.ttl},
+		Ns: nsName + zone,
+	}
+}
+
+// soa returns the SOA record of the zone. Its serial changes whenever the ServiceImports change.
+func (m MulticlusterGw) soa(zone string) *dns.SOA {
+	return &dns.SOA{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: m.ttl},
+		Ns:      nsName + zone,
+		Mbox:    dnsutil.Join("hostmaster", zone),
+		Serial:  m.Store.Serial(),
+		Refresh: 7200,
+		Retry:   1800,
+		Expire:  86400,
+		Minttl:  m.negativeTTL,
+	}
+}
+
 // Name implements the Handler interface.
 func (m MulticlusterGw) Name() string { return pluginName }
 
@@ -148,25 +459,184 @@ func (m MulticlusterGw) IsNameError(err error) bool {
 }
 
 // NewA returns a new A record based on the Service.
-func NewARecord(name string, ip net.IP) *dns.A {
+func NewARecord(name string, ip net.IP, ttl uint32) *dns.A {
 	return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA,
-		Class: dns.ClassINET, Ttl: defaultTTL}, A: ip}
+		Class: dns.ClassINET, Ttl: ttl}, A: ip}
 }
 
 // NewAAAA returns a new AAAA record based on the Service.
-func NewAAAARecord(name string, ip net.IP) *dns.AAAA {
+func NewAAAARecord(name string, ip net.IP, ttl uint32) *dns.AAAA {
 	return &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA,
-		Class: dns.ClassINET, Ttl: defaultTTL}, AAAA: ip}
+		Class: dns.ClassINET, Ttl: ttl}, AAAA: ip}
+}
+
+// newARecords returns an A record for every one of the ips.
+func newARecords(name string, ips []net.IP, ttl uint32) []dns.RR {
+	records := make([]dns.RR, 0, len(ips))
+	for _, ip := range ips {
+		records = append(records, NewARecord(name, ip, ttl))
+	}
+	return records
 }
 
-// parseReqNameNs gets a qnamed request (that was already trimmed from the zone)
-// it returns the name and ns of the wanted serviceImport from the request.
-func parseReqNameNs(qnameTrimmed string) (string, string) {
-	// TODO: might add error checking? or its clear that should contain .
-	firstDotIndex := strings.IndexByte(qnameTrimmed, '.')
+// newAAAARecords returns an AAAA record for every one of the ips.
+func newAAAARecords(name string, ips []net.IP, ttl uint32) []dns.RR {
+	records := make([]dns.RR, 0, len(ips))
+	for _, ip := range ips {
+		records = append(records, NewAAAARecord(name, ip, ttl))
+	}
+	return records
+}
 
-	name := qnameTrimmed[:firstDotIndex]
-	ns := qnameTrimmed[firstDotIndex+1:]
-	ns = ns[:len(ns)-1] // remove the dot in the end
-	return name, ns
+// ttlOf returns the TTL of the records of the ServiceImport: its own TTL if it overrides it, or the TTL of the plugin.
+func (m MulticlusterGw) ttlOf(siInfo ServiceImportInfo) uint32 {
+	if siInfo.TTL != nil {
+		return *siInfo.TTL
+	}
+	return m.ttl
+}
+
+// answerIPs returns the IPv4 and IPv6 addresses that the ServiceImport is answered with.
+// These are its addresses (see addressesOf), where the gateway addresses are chosen by the policy of the gateway.
+// If none of the gateway addresses of the asked family can be answered because they are all unhealthy,
+// errGatewaysDown is returned. The family is by qtype: A for IPv4, AAAA for IPv6, and both for any other type.
+func (m MulticlusterGw) answerIPs(qname string, namespace string, siInfo ServiceImportInfo, qtype uint16) ([]net.IP, []net.IP, error) {
+	ip4, ip6, source := m.addressesOf(qname, namespace, siInfo)
+	if source == fromServiceImport {
+		return ip4, ip6, nil
+	}
+	picked4, picked6 := m.gateway.pick4(ip4), m.gateway.pick6(ip6)
+	down4 := len(ip4) > 0 && len(picked4) == 0
+	down6 := len(ip6) > 0 && len(picked6) == 0
+	var down bool
+	switch qtype {
+	case dns.TypeA:
+		down = down4
+	case dns.TypeAAAA:
+		down = down6
+	default:
+		down = len(picked4) == 0 && len(picked6) == 0 && (down4 || down6)
+	}
+	if down {
+		return nil, nil, errGatewaysDown
+	}
+	return picked4, picked6, nil
+}
+
+// The sources of the addresses that a ServiceImport resolves to.
+type addressSource int
+
+const (
+	fromServiceImport addressSource = iota // its ClusterSetIPs, or the addresses of the endpoints of a headless ServiceImport
+	fromOwnGateway                         // the gateway of the ServiceImport, or of its namespace
+	fromPluginGateway                      // the gateway of the plugin
+)
+
+// addressesOf returns all the IPv4 and IPv6 addresses that the ServiceImport resolves to, and where they come from.
+// A headless ServiceImport resolves to the addresses of its endpoints.
+// Otherwise, these are the ClusterSetIPs of the ServiceImport, if the ClusterSetIP mode is on for it (by its zone
+// or by its annotation) and it has ones assigned. Otherwise, these are the addresses of its gateway, if it overrides the
+// gateway by its annotations, or else of the gateway of its namespace, if it has one, or else the addresses of the
+// gateway of the plugin (see gatewayIPs).
+func (m MulticlusterGw) addressesOf(qname string, namespace string, siInfo ServiceImportInfo) ([]net.IP, []net.IP, addressSource) {
+	if siInfo.Type == mcsv1a1.Headless {
+		var ips []net.IP
+		for _, endpoint := range siInfo.Endpoints {
+			ips = append(ips, endpoint.IPs...)
+		}
+		ip4, ip6 := splitIPFamilies(ips)
+		return ip4, ip6, fromServiceImport
+	}
+	if m.useClusterSetIP(qname, siInfo) && len(siInfo.IPs) > 0 {
+		ip4, ip6 := splitIPFamilies(siInfo.IPs)
+		return ip4, ip6, fromServiceImport
+	}
+	if len(siInfo.GatewayIPs) > 0 || siInfo.GatewayRef != "" {
+		// the ServiceImport has its own gateway, even if it has no addresses:
+		ip4, ip6 := splitIPFamilies(siInfo.GatewayIPs)
+		return ip4, ip6, fromOwnGateway
+	}
+	if ip4, ip6, exists := m.namespaceGateways.lookup(namespace); exists {
+		return ip4, ip6, fromOwnGateway
+	}
+	ip4, ip6 := m.gatewayIPs()
+	return ip4, ip6, fromPluginGateway
+}
+
+// splitIPFamilies splits the ips to the IPv4 and the IPv6 ones.
+func splitIPFamilies(ips []net.IP) ([]net.IP, []net.IP) {
+	var ip4, ip6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ip4 = append(ip4, ip)
+		} else {
+			ip6 = append(ip6, ip)
+		}
+	}
+	return ip4, ip6
+}
+
+// useClusterSetIP returns if the ClusterSetIPs of the ServiceImport should be answered instead of the gateway.
+// The annotation of the ServiceImport wins over the mode of its zone.
+func (m MulticlusterGw) useClusterSetIP(qname string, siInfo ServiceImportInfo) bool {
+	if siInfo.Type != "" && siInfo.Type != mcsv1a1.ClusterSetIP {
+		return false
+	}
+	switch siInfo.AnswerMode {
+	case answerClusterSetIP:
+		return true
+	case answerGateway:
+		return false
+	}
+	return plugin.Zones(m.clusterSetIPZones).Matches(qname) != ""
+}
+
+// NewPTRRecord returns a new PTR record, pointing to the target.
+func NewPTRRecord(name string, target string, ttl uint32) *dns.PTR {
+	return &dns.PTR{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR,
+		Class: dns.ClassINET, Ttl: ttl}, Ptr: target}
+}
+
+// NewSRVRecord returns a new SRV record, pointing to the target in the given port.
+func NewSRVRecord(name string, port uint16, target string, ttl uint32) *dns.SRV {
+	return &dns.SRV{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeSRV,
+		Class: dns.ClassINET, Ttl: ttl}, Priority: 0, Weight: 100, Port: port, Target: target}
+}
+
+// srvRecords returns the SRV records of the ServiceImport's ports, and the glue records of their targets.
+// The records point to the service name (svcTarget), or for a headless ServiceImport to the names of
+// its endpoints (hostname.clusterid.svc.ns.zone), for the endpoints that have hostnames.
+// errGatewaysDown is returned if the targets are the gateway, and all its addresses are unhealthy.
+func (m MulticlusterGw) srvRecords(qnameLower string, qname string, svcTarget string, namespace string, siInfo ServiceImportInfo) ([]dns.RR, []dns.RR, error) {
+	type srvTarget struct {
+		name     string
+		ip4, ip6 []net.IP
+	}
+	var targets []srvTarget
+	if siInfo.Type == mcsv1a1.Headless {
+		for _, endpoint := range siInfo.Endpoints {
+			if endpoint.Hostname == "" {
+				continue
+			}
+			ip4, ip6 := splitIPFamilies(endpoint.IPs)
+			targets = append(targets, srvTarget{endpoint.Hostname + "." + endpoint.ClusterID + "." + svcTarget, ip4, ip6})
+		}
+	} else {
+		ip4, ip6, err := m.answerIPs(qnameLower, namespace, siInfo, dns.TypeSRV)
+		if err != nil {
+			return nil, nil, err
+		}
+		targets = append(targets, srvTarget{svcTarget, ip4, ip6})
+	}
+
+	ttl := m.ttlOf(siInfo)
+	var records, extra []dns.RR
+	for _, target := range targets {
+		for _, siPort := range siInfo.Ports {
+			records = append(records, NewSRVRecord(qname, uint16(siPort.Port), target.name, ttl))
+		}
+		extra = append(extra, newARecords(target.name, target.ip4, ttl)...)
+		extra = append(extra, newAAAARecords(target.name, target.ip6, ttl)...)
+	}
+	return records, extra, nil
 }
@@ -2,12 +2,17 @@ package multicluster_gw
 
 import (
 	"context"
+	"fmt"
+	"net"
 	"testing"
 
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	"github.com/coredns/coredns/plugin/test"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	mcsv1a1 "sigs.k8s.io/mcs-api/pkg/apis/v1alpha1"
 )
 
 func TestMultiClusterGw(t *testing.T) {
@@ -18,8 +23,9 @@ func TestMultiClusterGw(t *testing.T) {
 		questionType        uint16 // The given request type
 		shouldErr           bool   // True if test case is expected to produce an error.
 		expectedReturnValue int    // The expected return value.
+		expectedRcode       int    // The expected rcode of the written message.
 		expectedErrContent  error  // The expected error
-		addToSet            bool
+		addToStore          bool
 	}{
 		// positive
 		{
@@ -29,6 +35,7 @@ func TestMultiClusterGw(t *testing.T) {
 			dns.TypeA,
 			false,
 			dns.RcodeSuccess,
+			dns.RcodeSuccess,
 			nil,
 			true,
 		},
@@ -40,32 +47,46 @@ func TestMultiClusterGw(t *testing.T) {
 			dns.TypeA,
 			false,
 			dns.RcodeServerFailure,
+			dns.RcodeServerFailure,
 			nil,
 			true,
 		},
 
-		//not in the set, should return NODATA:
+		//not in the store, should return NXDOMAIN:
 		{
 			`myservice.test.svc.clusterset.local.`,
 			"myservice",
 			"test",
 			dns.TypeA,
 			false,
+			dns.RcodeSuccess,
 			dns.RcodeNameError,
 			nil,
 			false,
 		},
+		// in the store, but no records of the requested type, should return NODATA:
+		{
+			`myservice.test.svc.clusterset.local.`,
+			"myservice",
+			"test",
+			dns.TypeMX,
+			false,
+			dns.RcodeSuccess,
+			dns.RcodeSuccess,
+			nil,
+			true,
+		},
 	}
-	initMcgw()
+	mcgw := initMcgw()
 	ctx := context.TODO()
 	r := new(dns.Msg)
 	rec := dnstest.NewRecorder((&test.ResponseWriter{}))
 	for _, test := range tests {
-		initalizeSetForTest(test.question, test.serviceName, test.serviceNs, test.addToSet)
+		initalizeStoreForTest(mcgw, test.serviceName, test.serviceNs, test.addToStore)
 		r.SetQuestion(test.question, test.questionType)
 
 		// call the plugin and check result:
-		returnValue, err := Mcgw.ServeDNS(ctx, rec, r)
+		returnValue, err := mcgw.ServeDNS(ctx, rec, r)
 
 		assert.Equal(t, test.expectedReturnValue, returnValue)
 		if test.shouldErr {
@@ -73,24 +94,727 @@ func TestMultiClusterGw(t *testing.T) {
 		} else {
 			assert.Nil(t, err)
 		}
+		assert.Equal(t, test.expectedRcode, rec.Msg.Rcode)
+	}
+}
+
+func TestMultiClusterGwNegative(t *testing.T) {
+	tests := []struct {
+		question        string // the request name
+		questionType    uint16 // The given request type
+		expectedRcode   int    // The expected rcode of the written message.
+		expectedAnswers int    // The expected number of answers.
+	}{
+		// positive
+		{`myservice.test.svc.clusterset.local.`, dns.TypeA, dns.RcodeSuccess, 1},
+		// NODATA - the name exists:
+		{`myservice.test.svc.clusterset.local.`, dns.TypeTXT, dns.RcodeSuccess, 0},
+		{`myservice.test.svc.clusterset.local.`, dns.TypeAAAA, dns.RcodeSuccess, 0}, // no IPv6 gateway
+		{`_http._tcp.myservice.test.svc.clusterset.local.`, dns.TypeA, dns.RcodeSuccess, 0},
+		// NXDOMAIN - the name doesn't exist:
+		{`other.test.svc.clusterset.local.`, dns.TypeA, dns.RcodeNameError, 0},
+		{`other.test.svc.clusterset.local.`, dns.TypeTXT, dns.RcodeNameError, 0},
+		{`_grpc._tcp.myservice.test.svc.clusterset.local.`, dns.TypeSRV, dns.RcodeNameError, 0},
+		// only the namespace, exists if it has any SI:
+		{`test.svc.clusterset.local.`, dns.TypeA, dns.RcodeSuccess, 0},
+		{`other-ns.svc.clusterset.local.`, dns.TypeA, dns.RcodeNameError, 0},
+		// names that can't exist:
+		{`a.b.c.myservice.test.svc.clusterset.local.`, dns.TypeA, dns.RcodeNameError, 0},
+	}
+	mcgw := initMcgw()
+	mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: "myservice"}, &ServiceImportInfo{
+		Ports: []mcsv1a1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80}},
+	})
+	ctx := context.TODO()
+	rec := dnstest.NewRecorder((&test.ResponseWriter{}))
+
+	for i, test := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(test.question, test.questionType)
+
+		returnValue, err := mcgw.ServeDNS(ctx, rec, r)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, returnValue, "Test %d", i)
+		assert.Equal(t, test.expectedRcode, rec.Msg.Rcode, "Test %d", i)
+		assert.True(t, rec.Msg.Authoritative, "Test %d", i)
+		assert.Len(t, rec.Msg.Answer, test.expectedAnswers, "Test %d", i)
+		if test.expectedAnswers > 0 {
+			continue
+		}
+
+		// negative answers have the SOA of the zone in the authority section:
+		assert.Len(t, rec.Msg.Ns, 1, "Test %d", i)
+		soa, isSOA := rec.Msg.Ns[0].(*dns.SOA)
+		assert.True(t, isSOA, "Test %d", i)
+		assert.Equal(t, "svc.clusterset.local.", soa.Hdr.Name, "Test %d", i)
+		assert.Equal(t, uint32(defaultTTL), soa.Minttl, "Test %d", i)
 	}
+
+	// malformed port labels:
+	r := new(dns.Msg)
+	r.SetQuestion(`_http.myservice.test.svc.clusterset.local.`, dns.TypeSRV)
+	returnValue, err := mcgw.ServeDNS(ctx, rec, r)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, returnValue)
+	assert.Equal(t, dns.RcodeFormatError, rec.Msg.Rcode)
+
+	// a dual-stack gateway answers AAAA requests with its IPv6 address:
+	mcgw.gatewayIp6 = []net.IP{net.ParseIP("fd00::6")}
+	r.SetQuestion(`myservice.test.svc.clusterset.local.`, dns.TypeAAAA)
+	_, err = mcgw.ServeDNS(ctx, rec, r)
+	assert.Nil(t, err)
+	assert.Len(t, rec.Msg.Answer, 1)
+	assert.Equal(t, "myservice.test.svc.clusterset.local.\t5\tIN\tAAAA\tfd00::6", rec.Msg.Answer[0].String())
 }
 
-// Function to initalize our set with a serviceImport for service with name svcName, under Ns svcNs.
-// Boolean condition that determine if we do add the service to the set, or not (we add it only if the test wants that this serviceImport will exist).
-func initalizeSetForTest(qustion string, svcName string, svcNS string, addToSet bool) {
-	// empty the set in each test run:
-	Mcgw.SISet = *NewSiSet()
+// Function to initalize our store with a serviceImport for service with name svcName, under Ns svcNs.
+// Boolean condition that determine if we do add the service to the store, or not (we add it only if the test wants that this serviceImport will exist).
+func initalizeStoreForTest(mcgw *MulticlusterGw, svcName string, svcNS string, addToStore bool) {
+	// empty the store in each test run:
+	mcgw.Store = NewStore()
 
-	if addToSet {
-		// add the current SI to the set:
-		Mcgw.SISet.Add(GenerateNameAsString(svcName, svcNS))
+	if addToStore {
+		// add the current SI to the store:
+		mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: svcNS, Name: svcName}, nil)
 	}
 }
 
-func initMcgw() {
+func initMcgw() *MulticlusterGw {
 	requestsZone := "svc.clusterset.local."
-	Mcgw.SISet = *NewSiSet()
-	Mcgw.Zones = []string{requestsZone}
-	Mcgw.Next = test.ErrorHandler()
+	mcgw := &MulticlusterGw{Store: NewStore()}
+	mcgw.New([]string{requestsZone})
+	mcgw.Next = test.ErrorHandler()
+	return mcgw
+}
+
+func TestMultiClusterGwSRV(t *testing.T) {
+	tests := []struct {
+		question      string   // the request name
+		expectedRcode int      // The expected rcode of the written message.
+		expectedPorts []uint16 // The expected ports in the SRV answers, in order.
+	}{
+		// bare service name, a record for every port:
+		{
+			`myservice.test.svc.clusterset.local.`,
+			dns.RcodeSuccess,
+			[]uint16{80, 53},
+		},
+		// a specific port:
+		{
+			`_http._tcp.myservice.test.svc.clusterset.local.`,
+			dns.RcodeSuccess,
+			[]uint16{80},
+		},
+		{
+			`_dns._UDP.myservice.test.svc.clusterset.local.`,
+			dns.RcodeSuccess,
+			[]uint16{53},
+		},
+		// port with a wrong protocol:
+		{
+			`_http._udp.myservice.test.svc.clusterset.local.`,
+			dns.RcodeNameError,
+			nil,
+		},
+		// SI that dosen't exist:
+		{
+			`_http._tcp.other.test.svc.clusterset.local.`,
+			dns.RcodeNameError,
+			nil,
+		},
+	}
+	mcgw := initMcgw()
+	mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: "myservice"}, &ServiceImportInfo{
+		Ports: []mcsv1a1.ServicePort{
+			{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80},
+			{Name: "dns", Protocol: corev1.ProtocolUDP, Port: 53},
+		},
+	})
+	ctx := context.TODO()
+	rec := dnstest.NewRecorder((&test.ResponseWriter{}))
+
+	for i, test := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(test.question, dns.TypeSRV)
+
+		returnValue, err := mcgw.ServeDNS(ctx, rec, r)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, returnValue, "Test %d", i)
+		assert.Equal(t, test.expectedRcode, rec.Msg.Rcode, "Test %d", i)
+		if test.expectedRcode != dns.RcodeSuccess {
+			continue
+		}
+
+		ports := make([]uint16, 0, len(rec.Msg.Answer))
+		for _, rr := range rec.Msg.Answer {
+			srv := rr.(*dns.SRV)
+			assert.Equal(t, "myservice.test.svc.clusterset.local.", srv.Target, "Test %d", i)
+			ports = append(ports, srv.Port)
+		}
+		assert.Equal(t, test.expectedPorts, ports, "Test %d", i)
+
+		// the glue records of the target (there is no IPv6 gateway):
+		assert.Len(t, rec.Msg.Extra, 1, "Test %d", i)
+		assert.Equal(t, dns.TypeA, rec.Msg.Extra[0].Header().Rrtype, "Test %d", i)
+	}
+}
+
+func TestMultiClusterGwClusterSetIP(t *testing.T) {
+	vip := net.ParseIP("10.0.0.10")
+	tests := []struct {
+		clusterSetIPZones []string           // the zones of the ClusterSetIP mode
+		siInfo            *ServiceImportInfo // the info of the requested SI
+		expectedIP        net.IP             // the expected ip in the A answer
+	}{
+		// the mode is off:
+		{
+			nil,
+			&ServiceImportInfo{Type: mcsv1a1.ClusterSetIP, IPs: []net.IP{vip}},
+			defaultGwIpv4,
+		},
+		// the mode is on for the zone:
+		{
+			[]string{"svc.clusterset.local."},
+			&ServiceImportInfo{Type: mcsv1a1.ClusterSetIP, IPs: []net.IP{vip}},
+			vip,
+		},
+		// the mode is on for another zone:
+		{
+			[]string{"other.local."},
+			&ServiceImportInfo{Type: mcsv1a1.ClusterSetIP, IPs: []net.IP{vip}},
+			defaultGwIpv4,
+		},
+		// the mode is on, but no ips were assigned - fallback to the gateway:
+		{
+			[]string{"svc.clusterset.local."},
+			&ServiceImportInfo{Type: mcsv1a1.ClusterSetIP},
+			defaultGwIpv4,
+		},
+		// the annotation turns the mode on:
+		{
+			nil,
+			&ServiceImportInfo{Type: mcsv1a1.ClusterSetIP, IPs: []net.IP{vip}, AnswerMode: answerClusterSetIP},
+			vip,
+		},
+		// the annotation turns the mode off:
+		{
+			[]string{"svc.clusterset.local."},
+			&ServiceImportInfo{Type: mcsv1a1.ClusterSetIP, IPs: []net.IP{vip}, AnswerMode: answerGateway},
+			defaultGwIpv4,
+		},
+	}
+	ctx := context.TODO()
+	rec := dnstest.NewRecorder((&test.ResponseWriter{}))
+
+	for i, test := range tests {
+		mcgw := initMcgw()
+		mcgw.clusterSetIPZones = test.clusterSetIPZones
+		mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: "myservice"}, test.siInfo)
+		r := new(dns.Msg)
+		r.SetQuestion("myservice.test.svc.clusterset.local.", dns.TypeA)
+
+		returnValue, err := mcgw.ServeDNS(ctx, rec, r)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, returnValue, "Test %d", i)
+		assert.Len(t, rec.Msg.Answer, 1, "Test %d", i)
+		assert.True(t, rec.Msg.Answer[0].(*dns.A).A.Equal(test.expectedIP), "Test %d: expected %v, found %v", i, test.expectedIP, rec.Msg.Answer[0])
+	}
+}
+
+func TestMultiClusterGwHeadless(t *testing.T) {
+	tests := []struct {
+		question        string   // the request name
+		questionType    uint16   // The given request type
+		expectedRcode   int      // The expected rcode of the written message.
+		expectedAnswers []string // The expected answers, as strings.
+	}{
+		// the bare name resolves to all the endpoints:
+		{
+			`kafka.test.svc.clusterset.local.`,
+			dns.TypeA,
+			dns.RcodeSuccess,
+			[]string{
+				"kafka.test.svc.clusterset.local.\t5\tIN\tA\t10.0.1.1",
+				"kafka.test.svc.clusterset.local.\t5\tIN\tA\t10.0.1.2",
+				"kafka.test.svc.clusterset.local.\t5\tIN\tA\t10.0.2.1",
+			},
+		},
+		// the endpoints of a cluster:
+		{
+			`c1.kafka.test.svc.clusterset.local.`,
+			dns.TypeA,
+			dns.RcodeSuccess,
+			[]string{
+				"c1.kafka.test.svc.clusterset.local.\t5\tIN\tA\t10.0.1.1",
+				"c1.kafka.test.svc.clusterset.local.\t5\tIN\tA\t10.0.1.2",
+			},
+		},
+		// a single endpoint:
+		{
+			`kafka-1.c1.kafka.test.svc.clusterset.local.`,
+			dns.TypeA,
+			dns.RcodeSuccess,
+			[]string{"kafka-1.c1.kafka.test.svc.clusterset.local.\t5\tIN\tA\t10.0.1.2"},
+		},
+		// SRV records point to the endpoints with hostnames:
+		{
+			`_kafka._tcp.kafka.test.svc.clusterset.local.`,
+			dns.TypeSRV,
+			dns.RcodeSuccess,
+			[]string{
+				"_kafka._tcp.kafka.test.svc.clusterset.local.\t5\tIN\tSRV\t0 100 9092 kafka-0.c1.kafka.test.svc.clusterset.local.",
+				"_kafka._tcp.kafka.test.svc.clusterset.local.\t5\tIN\tSRV\t0 100 9092 kafka-1.c1.kafka.test.svc.clusterset.local.",
+			},
+		},
+		// unknown endpoint, cluster, or a name of an endpoint of a service that isn't headless:
+		{
+			`kafka-5.c1.kafka.test.svc.clusterset.local.`,
+			dns.TypeA,
+			dns.RcodeNameError,
+			nil,
+		},
+		{
+			`c3.kafka.test.svc.clusterset.local.`,
+			dns.TypeA,
+			dns.RcodeNameError,
+			nil,
+		},
+		{
+			`c1.myservice.test.svc.clusterset.local.`,
+			dns.TypeA,
+			dns.RcodeNameError,
+			nil,
+		},
+	}
+	mcgw := initMcgw()
+	mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: "kafka"}, &ServiceImportInfo{
+		Type:  mcsv1a1.Headless,
+		Ports: []mcsv1a1.ServicePort{{Name: "kafka", Protocol: corev1.ProtocolTCP, Port: 9092}},
+		Endpoints: []Endpoint{
+			{ClusterID: cluster1, Hostname: "kafka-0", IPs: []net.IP{net.ParseIP("10.0.1.1")}},
+			{ClusterID: cluster1, Hostname: "kafka-1", IPs: []net.IP{net.ParseIP("10.0.1.2")}},
+			{ClusterID: cluster2, IPs: []net.IP{net.ParseIP("10.0.2.1")}},
+		},
+	})
+	mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: "myservice"}, &ServiceImportInfo{Type: mcsv1a1.ClusterSetIP})
+	ctx := context.TODO()
+	rec := dnstest.NewRecorder((&test.ResponseWriter{}))
+
+	for i, test := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(test.question, test.questionType)
+
+		returnValue, err := mcgw.ServeDNS(ctx, rec, r)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, returnValue, "Test %d", i)
+		assert.Equal(t, test.expectedRcode, rec.Msg.Rcode, "Test %d", i)
+		if test.expectedRcode != dns.RcodeSuccess {
+			continue
+		}
+
+		answers := make([]string, 0, len(rec.Msg.Answer))
+		for _, rr := range rec.Msg.Answer {
+			answers = append(answers, rr.String())
+		}
+		assert.Equal(t, test.expectedAnswers, answers, "Test %d", i)
+	}
+}
+
+func TestMultiClusterGwApex(t *testing.T) {
+	tests := []struct {
+		question        string   // the request name
+		questionType    uint16   // The given request type
+		expectedAnswers []string // The expected answers, as strings (without the SOA).
+		expectedExtra   []string // The expected extra records, as strings.
+	}{
+		{`svc.clusterset.local.`, dns.TypeNS, []string{"svc.clusterset.local.\t5\tIN\tNS\tns.dns.svc.clusterset.local."},
+			[]string{"ns.dns.svc.clusterset.local.\t5\tIN\tA\t127.0.0.1"}},
+		{`ns.dns.svc.clusterset.local.`, dns.TypeA, []string{"ns.dns.svc.clusterset.local.\t5\tIN\tA\t127.0.0.1"}, nil},
+		// NODATA:
+		{`svc.clusterset.local.`, dns.TypeA, nil, nil},
+		{`ns.dns.svc.clusterset.local.`, dns.TypeAAAA, nil, nil},
+		// the name server of a reverse zone, and its glue:
+		{`in-addr.arpa.`, dns.TypeNS, []string{"in-addr.arpa.\t5\tIN\tNS\tns.dns.in-addr.arpa."},
+			[]string{"ns.dns.in-addr.arpa.\t5\tIN\tA\t127.0.0.1"}},
+		{`ns.dns.in-addr.arpa.`, dns.TypeA, []string{"ns.dns.in-addr.arpa.\t5\tIN\tA\t127.0.0.1"}, nil},
+	}
+	mcgw := initMcgw()
+	mcgw.New([]string{"svc.clusterset.local.", "in-addr.arpa."})
+	ctx := context.TODO()
+	rec := dnstest.NewRecorder((&test.ResponseWriter{}))
+
+	for i, test := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(test.question, test.questionType)
+
+		_, err := mcgw.ServeDNS(ctx, rec, r)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, rec.Msg.Rcode, "Test %d", i)
+		answers := []string(nil)
+		for _, rr := range rec.Msg.Answer {
+			answers = append(answers, rr.String())
+		}
+		assert.Equal(t, test.expectedAnswers, answers, "Test %d", i)
+		extra := []string(nil)
+		for _, rr := range rec.Msg.Extra {
+			extra = append(extra, rr.String())
+		}
+		assert.Equal(t, test.expectedExtra, extra, "Test %d", i)
+	}
+
+	// the serial of the SOA changes with the store:
+	soaSerial := func() uint32 {
+		r := new(dns.Msg)
+		r.SetQuestion("svc.clusterset.local.", dns.TypeSOA)
+		_, err := mcgw.ServeDNS(ctx, rec, r)
+		assert.Nil(t, err)
+		assert.Len(t, rec.Msg.Answer, 1)
+		return rec.Msg.Answer[0].(*dns.SOA).Serial
+	}
+	serial := soaSerial()
+	mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: "myservice"}, nil)
+	assert.Equal(t, serial+1, soaSerial())
+	mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: "myservice"}, nil)
+	assert.Equal(t, serial+1, soaSerial(), "a resync shouldn't change the serial")
+	mcgw.Store.Delete(cluster1, types.NamespacedName{Namespace: "test", Name: "myservice"})
+	assert.Equal(t, serial+2, soaSerial())
+}
+
+func TestMultiClusterGwPTR(t *testing.T) {
+	tests := []struct {
+		question        string   // the request name
+		gatewayHostname string   // the configured gateway hostname
+		expectedRcode   int      // The expected rcode of the written message.
+		expectedTargets []string // The expected targets of the PTR records.
+	}{
+		// ClusterSetIP:
+		{`10.0.0.10.in-addr.arpa.`, "", dns.RcodeSuccess, []string{"vip.test.svc.clusterset.local."}},
+		// the gateway, without a configured hostname, points to the ServiceImports that have it as their own gateway:
+		{`4.3.2.1.in-addr.arpa.`, "", dns.RcodeSuccess, []string{"own.test.svc.clusterset.local."}},
+		// the gateway, with a configured hostname:
+		{`4.3.2.1.in-addr.arpa.`, "gw.example.com.", dns.RcodeSuccess, []string{"gw.example.com."}},
+		// endpoint of a headless service:
+		{`1.2.0.10.in-addr.arpa.`, "", dns.RcodeSuccess, []string{"kafka-0.c1.kafka.test.svc.clusterset.local."}},
+		// ipv6 ClusterSetIP:
+		{`0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.`, "", dns.RcodeSuccess, []string{"vip.test.svc.clusterset.local."}},
+		// unknown address:
+		{`99.0.0.10.in-addr.arpa.`, "", dns.RcodeNameError, nil},
+	}
+	ctx := context.TODO()
+	rec := dnstest.NewRecorder((&test.ResponseWriter{}))
+
+	for i, test := range tests {
+		mcgw := initMcgw()
+		mcgw.New([]string{"svc.clusterset.local.", "in-addr.arpa.", "ip6.arpa."})
+		mcgw.clusterSetIPZones = []string{"svc.clusterset.local."}
+		mcgw.gatewayHostname = test.gatewayHostname
+		mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: "a"}, nil)
+		mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: "b"}, nil)
+		mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: "own"}, &ServiceImportInfo{
+			GatewayIPs: []net.IP{net.IPv4(1, 2, 3, 4).To4()},
+		})
+		mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: "vip"}, &ServiceImportInfo{
+			Type: mcsv1a1.ClusterSetIP,
+			IPs:  []net.IP{net.ParseIP("10.0.0.10"), net.ParseIP("fd00::10")},
+		})
+		mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: "kafka"}, &ServiceImportInfo{
+			Type:      mcsv1a1.Headless,
+			Endpoints: []Endpoint{{ClusterID: cluster1, Hostname: "kafka-0", IPs: []net.IP{net.ParseIP("10.0.2.1")}}},
+		})
+		r := new(dns.Msg)
+		r.SetQuestion(test.question, dns.TypePTR)
+
+		_, err := mcgw.ServeDNS(ctx, rec, r)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expectedRcode, rec.Msg.Rcode, "Test %d", i)
+		targets := []string(nil)
+		for _, rr := range rec.Msg.Answer {
+			targets = append(targets, rr.(*dns.PTR).Ptr)
+		}
+		assert.Equal(t, test.expectedTargets, targets, "Test %d", i)
+	}
+
+	// an address that many ServiceImports share is answered with the first of them by name:
+	mcgw := initMcgw()
+	mcgw.New([]string{"svc.clusterset.local.", "in-addr.arpa."})
+	mcgw.clusterSetIPZones = []string{"svc.clusterset.local."}
+	for i := 0; i < 2*maxPTRRecords; i++ {
+		mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: fmt.Sprintf("vip-%02d", i)}, &ServiceImportInfo{
+			Type: mcsv1a1.ClusterSetIP,
+			IPs:  []net.IP{net.ParseIP("10.0.0.20")},
+		})
+	}
+	r := new(dns.Msg)
+	r.SetQuestion(`20.0.0.10.in-addr.arpa.`, dns.TypePTR)
+	_, err := mcgw.ServeDNS(ctx, rec, r)
+	assert.Nil(t, err)
+	assert.Len(t, rec.Msg.Answer, maxPTRRecords)
+	assert.Equal(t, "vip-00.test.svc.clusterset.local.", rec.Msg.Answer[0].(*dns.PTR).Ptr)
+}
+
+// TestMultiClusterGwUnhealthyGateway checks the answers when the gateway addresses are unhealthy.
+func TestMultiClusterGwUnhealthyGateway(t *testing.T) {
+	tests := []struct {
+		allDown             string   // the mode of answering when all the gateway addresses are unhealthy.
+		up                  []string // the healthy gateway addresses.
+		expectedReturnValue int      // The expected return value.
+		expectedRcode       int      // The expected rcode of the written message.
+		expectedAnswers     []string // The expected A answers, by their addresses.
+	}{
+		{allDownServfail, []string{"6.6.6.6", "7.7.7.7"}, dns.RcodeSuccess, dns.RcodeSuccess, []string{"6.6.6.6", "7.7.7.7"}},
+		{allDownServfail, []string{"7.7.7.7"}, dns.RcodeSuccess, dns.RcodeSuccess, []string{"7.7.7.7"}},
+		{allDownServfail, nil, dns.RcodeSuccess, dns.RcodeServerFailure, nil},
+		// the next plugin (test.ErrorHandler) answers SERVFAIL itself:
+		{allDownFallthrough, nil, dns.RcodeServerFailure, dns.RcodeServerFailure, nil},
+		// the last healthy is 7.7.7.7, from the first round:
+		{allDownLastHealthy, nil, dns.RcodeSuccess, dns.RcodeSuccess, []string{"7.7.7.7"}},
+	}
+
+	ctx := context.TODO()
+	rec := dnstest.NewRecorder((&test.ResponseWriter{}))
+
+	for i, tc := range tests {
+		mcgw := initMcgw()
+		initalizeStoreForTest(mcgw, "myservice", "test", true)
+		mcgw.gatewayIp4 = []net.IP{net.IPv4(6, 6, 6, 6).To4(), net.IPv4(7, 7, 7, 7).To4()}
+		mcgw.gateway.allDown = tc.allDown
+		up := map[string]bool{"7.7.7.7": true}
+		mcgw.gateway.health = newHealthChecker(func(_ context.Context, ip net.IP) error {
+			if !up[ip.String()] {
+				return errNoItems
+			}
+			return nil
+		}, mcgw.gatewayAddresses)
+		mcgw.gateway.health.probeAll(ctx)
+		up = make(map[string]bool)
+		for _, ip := range tc.up {
+			up[ip] = true
+		}
+		mcgw.gateway.health.probeAll(ctx)
+
+		r := new(dns.Msg)
+		r.SetQuestion(`myservice.test.svc.clusterset.local.`, dns.TypeA)
+		returnValue, err := mcgw.ServeDNS(ctx, rec, r)
+		assert.Nil(t, err, "Test %d", i)
+		assert.Equal(t, tc.expectedReturnValue, returnValue, "Test %d", i)
+		assert.Equal(t, tc.expectedRcode, rec.Msg.Rcode, "Test %d", i)
+		var answers []string
+		for _, rr := range rec.Msg.Answer {
+			answers = append(answers, rr.(*dns.A).A.String())
+		}
+		assert.Equal(t, tc.expectedAnswers, answers, "Test %d", i)
+	}
+}
+
+// TestMultiClusterGwUnhealthyGatewayFamily checks that all the gateway addresses are down only by the family that is asked.
+func TestMultiClusterGwUnhealthyGatewayFamily(t *testing.T) {
+	mcgw := initMcgw()
+	mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: "myservice"},
+		&ServiceImportInfo{Ports: []mcsv1a1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80}}})
+	mcgw.gatewayIp4 = []net.IP{net.IPv4(6, 6, 6, 6).To4()}
+	mcgw.gatewayIp6 = []net.IP{net.ParseIP("fd00::6")}
+	mcgw.gateway.allDown = allDownServfail
+	// only the IPv6 address is healthy:
+	mcgw.gateway.health = newHealthChecker(func(_ context.Context, ip net.IP) error {
+		if ip.To4() != nil {
+			return errNoItems
+		}
+		return nil
+	}, mcgw.gatewayAddresses)
+	ctx := context.TODO()
+	mcgw.gateway.health.probeAll(ctx)
+	rec := dnstest.NewRecorder((&test.ResponseWriter{}))
+
+	tests := []struct {
+		qtype           uint16
+		expectedRcode   int
+		expectedAnswers int
+	}{
+		{dns.TypeA, dns.RcodeServerFailure, 0},
+		{dns.TypeAAAA, dns.RcodeSuccess, 1},
+		// the SRV targets are answered by the healthy family:
+		{dns.TypeSRV, dns.RcodeSuccess, 1},
+	}
+	for _, tc := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(`myservice.test.svc.clusterset.local.`, tc.qtype)
+		_, err := mcgw.ServeDNS(ctx, rec, r)
+		assert.Nil(t, err, dns.TypeToString[tc.qtype])
+		assert.Equal(t, tc.expectedRcode, rec.Msg.Rcode, dns.TypeToString[tc.qtype])
+		assert.Len(t, rec.Msg.Answer, tc.expectedAnswers, dns.TypeToString[tc.qtype])
+	}
+}
+
+// TestMultiClusterGwDiscoveredGateway checks that the discovered gateway addresses are answered, and follow their source.
+func TestMultiClusterGwDiscoveredGateway(t *testing.T) {
+	mcgw := initMcgw()
+	initalizeStoreForTest(mcgw, "myservice", "test", true)
+	mcgw.gatewayIp4 = nil
+	ctx := context.TODO()
+	rec := dnstest.NewRecorder((&test.ResponseWriter{}))
+	r := new(dns.Msg)
+	r.SetQuestion(`myservice.test.svc.clusterset.local.`, dns.TypeA)
+
+	// nothing was discovered yet:
+	_, err := mcgw.ServeDNS(ctx, rec, r)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, rec.Msg.Rcode)
+	assert.Empty(t, rec.Msg.Answer)
+
+	mcgw.gateway.setDiscovered("Service gw-ns/gw", []net.IP{net.IPv4(6, 6, 6, 6).To4()})
+	_, err = mcgw.ServeDNS(ctx, rec, r)
+	assert.Nil(t, err)
+	assert.Len(t, rec.Msg.Answer, 1)
+	assert.Equal(t, "6.6.6.6", rec.Msg.Answer[0].(*dns.A).A.String())
+
+	mcgw.gateway.setDiscovered("Service gw-ns/gw", []net.IP{net.IPv4(7, 7, 7, 7).To4()})
+	_, err = mcgw.ServeDNS(ctx, rec, r)
+	assert.Nil(t, err)
+	assert.Len(t, rec.Msg.Answer, 1)
+	assert.Equal(t, "7.7.7.7", rec.Msg.Answer[0].(*dns.A).A.String())
+}
+
+// TestMultiClusterGwServiceImportGateway checks that a ServiceImport with its own gateway is answered with it.
+func TestMultiClusterGwServiceImportGateway(t *testing.T) {
+	tests := []struct {
+		serviceName     string
+		info            *ServiceImportInfo
+		questionType    uint16
+		expectedAnswers []string // The expected answers, by their addresses.
+	}{
+		{"myservice", nil, dns.TypeA, []string{"1.2.3.4"}},
+		{"own-gateway", &ServiceImportInfo{GatewayIPs: []net.IP{net.IPv4(6, 6, 6, 6).To4(), net.ParseIP("fd00::6")}}, dns.TypeA, []string{"6.6.6.6"}},
+		{"own-gateway", &ServiceImportInfo{GatewayIPs: []net.IP{net.IPv4(6, 6, 6, 6).To4(), net.ParseIP("fd00::6")}}, dns.TypeAAAA, []string{"fd00::6"}},
+		// a Gateway without addresses isn't replaced by the gateway of the plugin:
+		{"missing-gateway", &ServiceImportInfo{GatewayRef: "gw-ns/gw"}, dns.TypeA, nil},
+	}
+
+	ctx := context.TODO()
+	rec := dnstest.NewRecorder((&test.ResponseWriter{}))
+
+	for i, tc := range tests {
+		mcgw := initMcgw()
+		mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: tc.serviceName}, tc.info)
+		r := new(dns.Msg)
+		r.SetQuestion(tc.serviceName+`.test.svc.clusterset.local.`, tc.questionType)
+		_, err := mcgw.ServeDNS(ctx, rec, r)
+		assert.Nil(t, err, "Test %d", i)
+		assert.Equal(t, dns.RcodeSuccess, rec.Msg.Rcode, "Test %d", i)
+		var answers []string
+		for _, rr := range rec.Msg.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				answers = append(answers, rr.A.String())
+			case *dns.AAAA:
+				answers = append(answers, rr.AAAA.String())
+			}
+		}
+		assert.Equal(t, tc.expectedAnswers, answers, "Test %d", i)
+	}
+}
+
+// TestMultiClusterGwNamespaceGateway checks that the gateway of a namespace is answered for its ServiceImports,
+// unless a ServiceImport has its own gateway.
+func TestMultiClusterGwNamespaceGateway(t *testing.T) {
+	tests := []struct {
+		serviceName     string
+		serviceNs       string
+		info            *ServiceImportInfo
+		expectedAnswers []string // The expected A answers, by their addresses.
+	}{
+		{"myservice", "tenant", nil, []string{"6.6.6.6"}},
+		{"myservice", "test", nil, []string{"1.2.3.4"}},
+		{"own-gateway", "tenant", &ServiceImportInfo{GatewayIPs: []net.IP{net.IPv4(7, 7, 7, 7).To4()}}, []string{"7.7.7.7"}},
+	}
+
+	ctx := context.TODO()
+	rec := dnstest.NewRecorder((&test.ResponseWriter{}))
+
+	for i, tc := range tests {
+		mcgw := initMcgw()
+		mcgw.namespaceGateways.add(namespaceGateway{namespace: "tenant", ip4: []net.IP{net.IPv4(6, 6, 6, 6).To4()}})
+		mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: tc.serviceNs, Name: tc.serviceName}, tc.info)
+		r := new(dns.Msg)
+		r.SetQuestion(tc.serviceName+"."+tc.serviceNs+`.svc.clusterset.local.`, dns.TypeA)
+		_, err := mcgw.ServeDNS(ctx, rec, r)
+		assert.Nil(t, err, "Test %d", i)
+		var answers []string
+		for _, rr := range rec.Msg.Answer {
+			answers = append(answers, rr.(*dns.A).A.String())
+		}
+		assert.Equal(t, tc.expectedAnswers, answers, "Test %d", i)
+	}
+}
+
+// TestMultiClusterGwTTL checks the TTLs of the answers, of the plugin and of the ServiceImports that override it.
+func TestMultiClusterGwTTL(t *testing.T) {
+	shortTTL := uint32(1)
+	tests := []struct {
+		question     string
+		questionType uint16
+		expectedTTL  uint32 // The expected TTL of the answer, or of the SOA of a negative answer.
+	}{
+		{`myservice.test.svc.clusterset.local.`, dns.TypeA, 30},
+		{`short.test.svc.clusterset.local.`, dns.TypeA, shortTTL},
+		{`_http._tcp.short.test.svc.clusterset.local.`, dns.TypeSRV, shortTTL},
+		{`svc.clusterset.local.`, dns.TypeSOA, 30},
+		{`missing.test.svc.clusterset.local.`, dns.TypeA, 60},
+		{`myservice.test.svc.clusterset.local.`, dns.TypeTXT, 60},
+	}
+
+	mcgw := initMcgw()
+	mcgw.ttl, mcgw.negativeTTL = 30, 60
+	mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: "myservice"}, nil)
+	mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: "short"}, &ServiceImportInfo{
+		Ports: []mcsv1a1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80}},
+		TTL:   &shortTTL,
+	})
+	ctx := context.TODO()
+	rec := dnstest.NewRecorder((&test.ResponseWriter{}))
+
+	for i, tc := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tc.question, tc.questionType)
+		_, err := mcgw.ServeDNS(ctx, rec, r)
+		assert.Nil(t, err, "Test %d", i)
+		if len(rec.Msg.Answer) == 0 {
+			assert.Len(t, rec.Msg.Ns, 1, "Test %d", i)
+			assert.Equal(t, tc.expectedTTL, rec.Msg.Ns[0].Header().Ttl, "Test %d", i)
+			assert.Equal(t, tc.expectedTTL, rec.Msg.Ns[0].(*dns.SOA).Minttl, "Test %d", i)
+			continue
+		}
+		for _, rr := range append(rec.Msg.Answer, rec.Msg.Extra...) {
+			assert.Equal(t, tc.expectedTTL, rr.Header().Ttl, "Test %d: %s", i, rr)
+		}
+	}
+}
+
+// benchmarkServeDNS answers A requests of the ServiceImports of the benchmark store, from benchmarkReaders goroutines.
+func benchmarkServeDNS(b *testing.B, changing bool) {
+	mcgw := initMcgw()
+	store, names := newBenchmarkStore()
+	mcgw.Store = store
+	qnames := make([]string, len(names))
+	for i, name := range names {
+		qnames[i] = name.Name + "." + name.Namespace + ".svc.clusterset.local."
+	}
+	ctx := context.TODO()
+
+	var write func(i int)
+	if changing {
+		write = func(i int) { updateBenchmarkStore(store, names, i) }
+	}
+	runReaders(b, func(i int) {
+		r := new(dns.Msg)
+		r.SetQuestion(qnames[i%len(qnames)], dns.TypeA)
+		mcgw.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), r)
+	}, write)
+}
+
+func BenchmarkServeDNS(b *testing.B) {
+	benchmarkServeDNS(b, false)
+}
+
+func BenchmarkServeDNSWhileChanging(b *testing.B) {
+	benchmarkServeDNS(b, true)
 }
@@ -0,0 +1,162 @@
+package multicluster_gw
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// namespaceGateway is the gateway of the ServiceImports of a namespace, or of the namespaces
+// that match a label selector.
+type namespaceGateway struct {
+	namespace string          // the name of the namespace, empty if the gateway is by selector
+	selector  labels.Selector // the selector of the labels of the namespaces, nil if the gateway is by name
+	ip4, ip6  []net.IP
+}
+
+// cacheSelectors restricts a cache to the Namespaces that match the selector of the gateway.
+func (g namespaceGateway) cacheSelectors() cache.SelectorsByObject {
+	return cache.SelectorsByObject{&corev1.Namespace{}: {Label: g.selector}}
+}
+
+// namespaceGateways keeps the gateways of the namespaces, and the namespaces that match the selectors.
+// A namespace gets the gateway of its name, or else the first gateway whose selector matches its labels.
+type namespaceGateways struct {
+	gateways []namespaceGateway
+
+	mutex    sync.RWMutex
+	matching map[int]map[string]void // the namespaces that match the selector of a gateway, by the index of the gateway
+}
+
+func newNamespaceGateways() *namespaceGateways {
+	return &namespaceGateways{matching: make(map[int]map[string]void)}
+}
+
+// add adds the gateway of a namespace, or returns false if there is already a gateway of the namespace.
+func (ng *namespaceGateways) add(gateway namespaceGateway) bool {
+	if gateway.namespace != "" {
+		for _, other := range ng.gateways {
+			if other.namespace == gateway.namespace {
+				return false
+			}
+		}
+	}
+	ng.gateways = append(ng.gateways, gateway)
+	return true
+}
+
+// hasSelectors returns if any gateway is by selector, so the labels of the namespaces are needed.
+func (ng *namespaceGateways) hasSelectors() bool {
+	for _, gateway := range ng.gateways {
+		if gateway.selector != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the IPv4 and the IPv6 addresses of the gateway of the namespace, if it has one.
+func (ng *namespaceGateways) lookup(namespace string) ([]net.IP, []net.IP, bool) {
+	for _, gateway := range ng.gateways {
+		if gateway.namespace == namespace {
+			return gateway.ip4, gateway.ip6, true
+		}
+	}
+
+	ng.mutex.RLock()
+	defer ng.mutex.RUnlock()
+	for i, gateway := range ng.gateways {
+		if _, matches := ng.matching[i][namespace]; matches {
+			return gateway.ip4, gateway.ip6, true
+		}
+	}
+	return nil, nil, false
+}
+
+// addresses returns all the addresses of the gateways of the namespaces.
+func (ng *namespaceGateways) addresses() []net.IP {
+	var addresses []net.IP
+	for _, gateway := range ng.gateways {
+		addresses = mergeIPs(addresses, gateway.ip4)
+		addresses = mergeIPs(addresses, gateway.ip6)
+	}
+	return addresses
+}
+
+// setMatching sets if the namespace matches the selector of the gateway.
+func (ng *namespaceGateways) setMatching(gateway int, namespace string, matches bool) {
+	ng.mutex.Lock()
+	defer ng.mutex.Unlock()
+	if !matches {
+		delete(ng.matching[gateway], namespace)
+		return
+	}
+	if ng.matching[gateway] == nil {
+		ng.matching[gateway] = make(map[string]void)
+	}
+	ng.matching[gateway][namespace] = member
+}
+
+// NamespaceReconciler reconciles the Namespaces that match the selector of a namespace gateway,
+// to keep which namespaces get the gateway.
+type NamespaceReconciler struct {
+	client.Reader                    // the cache of the matching Namespaces, set by SetupWithManager
+	Gateways      *namespaceGateways // the namespace gateways of the plugin instance the reconciler reports to
+	Gateway       int                // the index of the gateway in Gateways, it must be by selector
+}
+
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+// Reconcile keeps if the Namespace matches the selector of the gateway.
+func (r *NamespaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	namespace := &corev1.Namespace{}
+	err := r.Get(ctx, req.NamespacedName, namespace)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// deleted, or its labels don't match anymore so it left the cache
+			r.Gateways.setMatching(r.Gateway, req.Name, false)
+			return ctrl.Result{}, nil
+		}
+		log.Errorf("Failed to get Namespace %s: %v", req.Name, err)
+		return ctrl.Result{}, err
+	}
+
+	selector := r.Gateways.gateways[r.Gateway].selector
+	r.Gateways.setMatching(r.Gateway, namespace.Name, selector.Matches(labels.Set(namespace.Labels)))
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager. The Namespaces are watched through a cache
+// of their own, that has only the Namespaces that match the selector, so the manager doesn't cache all
+// the Namespaces of the cluster.
+func (r *NamespaceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	namespaceCache, err := cache.New(mgr.GetConfig(), cache.Options{
+		Scheme:            mgr.GetScheme(),
+		Mapper:            mgr.GetRESTMapper(),
+		SelectorsByObject: r.Gateways.gateways[r.Gateway].cacheSelectors(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := mgr.Add(namespaceCache); err != nil {
+		return err
+	}
+	r.Reader = namespaceCache
+
+	c, err := controller.New(fmt.Sprintf("namespace-gateway-%d", r.Gateway), mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+	return c.Watch(source.NewKindWithCache(&corev1.Namespace{}, namespaceCache), &handler.EnqueueRequestForObject{})
+}
@@ -0,0 +1,78 @@
+package multicluster_gw
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// TestNamespaceGateways checks which gateway every namespace gets, by its name and its labels.
+func TestNamespaceGateways(t *testing.T) {
+	assert := require.New(t)
+	tenantA := []net.IP{net.IPv4(6, 6, 6, 6).To4()}
+	tenantB := []net.IP{net.IPv4(7, 7, 7, 7).To4()}
+	tenants := []net.IP{net.IPv4(8, 8, 8, 8).To4()}
+	ng := newNamespaceGateways()
+	assert.True(ng.add(namespaceGateway{namespace: "tenant-a", ip4: tenantA}))
+	assert.False(ng.add(namespaceGateway{namespace: "tenant-a", ip4: tenantB}))
+	assert.True(ng.add(namespaceGateway{selector: labels.SelectorFromSet(labels.Set{"tenant": "b"}), ip4: tenantB}))
+	assert.True(ng.add(namespaceGateway{selector: labels.SelectorFromSet(labels.Set{"tier": "tenant"}), ip4: tenants}))
+	assert.True(ng.hasSelectors())
+
+	objs := []runtime.Object{
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tenant-a", Labels: map[string]string{"tier": "tenant"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tenant-b", Labels: map[string]string{"tier": "tenant", "tenant": "b"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tenant-c", Labels: map[string]string{"tier": "tenant"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "infra"}},
+	}
+	client := getClient(objs)
+	// a reconciler for every selector:
+	for _, gateway := range []int{1, 2} {
+		nr := NamespaceReconciler{Reader: client, Gateways: ng, Gateway: gateway}
+		for _, namespace := range []string{"tenant-a", "tenant-b", "tenant-c", "infra", "deleted"} {
+			_, err := nr.Reconcile(context.TODO(), reconcile.Request{NamespacedName: types.NamespacedName{Name: namespace}})
+			assert.Nil(err)
+		}
+		// the Namespaces are cached by the selector:
+		for _, selector := range ng.gateways[gateway].cacheSelectors() {
+			assert.Equal(ng.gateways[gateway].selector, selector.Label)
+		}
+	}
+
+	tests := []struct {
+		namespace   string
+		expectedIp4 []net.IP
+		expected    bool
+	}{
+		{"tenant-a", tenantA, true}, // by name, before the selectors
+		{"tenant-b", tenantB, true}, // by the first selector that matches
+		{"tenant-c", tenants, true},
+		{"infra", nil, false},
+		{"deleted", nil, false},
+	}
+	for i, test := range tests {
+		ip4, _, exists := ng.lookup(test.namespace)
+		assert.Equal(test.expected, exists, "Test %d", i)
+		assert.Equal(test.expectedIp4, ip4, "Test %d", i)
+	}
+	assert.Equal([]net.IP{tenantA[0], tenantB[0], tenants[0]}, ng.addresses())
+
+	// a namespace whose labels stopped matching:
+	namespace := objs[1].(*corev1.Namespace)
+	namespace.Labels = map[string]string{"tier": "tenant"}
+	assert.Nil(client.Update(context.TODO(), namespace))
+	nr := NamespaceReconciler{Reader: client, Gateways: ng, Gateway: 1}
+	_, err := nr.Reconcile(context.TODO(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "tenant-b"}})
+	assert.Nil(err)
+	ip4, _, exists := ng.lookup("tenant-b")
+	assert.True(exists)
+	assert.Equal(tenants, ip4)
+}
@@ -0,0 +1,77 @@
+package multicluster_gw
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// recordRequest is a parsed request name, that was already trimmed from the zone. It is one of:
+//
+//	namespace.                                (only the namespace, an empty non-terminal)
+//	service.namespace.
+//	clusterid.service.namespace.              (the endpoints of a headless service in a cluster)
+//	hostname.clusterid.service.namespace.     (an endpoint of a headless service)
+//	_port._protocol.service.namespace.        (SRV of a port)
+type recordRequest struct {
+	port      string // the name of the port, without the '_'
+	protocol  string // the protocol of the port, without the '_'
+	hostname  string
+	cluster   string
+	service   string
+	namespace string
+}
+
+// parseRequest parses a qnamed request (that was already trimmed from the zone) to a recordRequest.
+// The labels are lower cased, as the names of k8s objects are.
+// It returns errInvalidRequest if the name can't exist in the zone (NXDOMAIN), and errMalformedRequest
+// if the name has port labels that aren't well formed (FORMERR).
+func parseRequest(qnameTrimmed string) (recordRequest, error) {
+	r := recordRequest{}
+	labels := dns.SplitDomainName(strings.ToLower(qnameTrimmed))
+	if len(labels) == 0 {
+		// the zone apex has no service
+		return r, errInvalidRequest
+	}
+	for _, label := range labels {
+		if label == "" {
+			return r, errMalformedRequest
+		}
+	}
+
+	// the port labels are the only ones that start with '_', and must come in pairs:
+	if strings.HasPrefix(labels[0], "_") {
+		if len(labels) < 2 || !strings.HasPrefix(labels[1], "_") || len(labels[0]) == 1 || len(labels[1]) == 1 {
+			return r, errMalformedRequest
+		}
+		if len(labels) != 4 {
+			return r, errInvalidRequest
+		}
+		r.port, r.protocol = labels[0][1:], labels[1][1:]
+		labels = labels[2:]
+	}
+	for _, label := range labels {
+		if strings.HasPrefix(label, "_") {
+			return r, errInvalidRequest
+		}
+	}
+
+	r.namespace = labels[len(labels)-1]
+	switch len(labels) {
+	case 1:
+	case 2:
+		r.service = labels[0]
+	case 3:
+		r.cluster, r.service = labels[0], labels[1]
+	case 4:
+		r.hostname, r.cluster, r.service = labels[0], labels[1], labels[2]
+	default:
+		return recordRequest{}, errInvalidRequest
+	}
+	return r, nil
+}
+
+// serviceName returns the name of the service in the zone (service.namespace.zone).
+func (r recordRequest) serviceName(zone string) string {
+	return r.service + "." + r.namespace + "." + zone
+}
@@ -0,0 +1,41 @@
+package multicluster_gw
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRequest(t *testing.T) {
+	tests := []struct {
+		qnameTrimmed    string        // the request name, trimmed from the zone
+		expectedRequest recordRequest // the expected parsed request
+		expectedErr     error         // the expected error
+	}{
+		{"myservice.test.", recordRequest{service: "myservice", namespace: "test"}, nil},
+		{"MyService.Test.", recordRequest{service: "myservice", namespace: "test"}, nil},
+		{"test.", recordRequest{namespace: "test"}, nil},
+		{"c1.kafka.test.", recordRequest{cluster: "c1", service: "kafka", namespace: "test"}, nil},
+		{"kafka-0.c1.kafka.test.", recordRequest{hostname: "kafka-0", cluster: "c1", service: "kafka", namespace: "test"}, nil},
+		{"_http._tcp.myservice.test.", recordRequest{port: "http", protocol: "tcp", service: "myservice", namespace: "test"}, nil},
+		// names that can't exist:
+		{"", recordRequest{}, errInvalidRequest},
+		{"a.b.c.d.e.", recordRequest{}, errInvalidRequest},
+		{"_http._tcp.test.", recordRequest{}, errInvalidRequest},
+		{"_http._tcp.c1.myservice.test.", recordRequest{}, errInvalidRequest},
+		{"_c1.myservice.test.", recordRequest{}, errMalformedRequest},
+		{"myservice._test.", recordRequest{}, errInvalidRequest},
+		// malformed port labels:
+		{"_http.myservice.test.", recordRequest{}, errMalformedRequest},
+		{"_._tcp.myservice.test.", recordRequest{}, errMalformedRequest},
+		{"_http._.myservice.test.", recordRequest{}, errMalformedRequest},
+	}
+
+	for i, test := range tests {
+		req, err := parseRequest(test.qnameTrimmed)
+		assert.Equal(t, test.expectedErr, err, "Test %d: %s", i, test.qnameTrimmed)
+		if err == nil {
+			assert.Equal(t, test.expectedRequest, req, "Test %d: %s", i, test.qnameTrimmed)
+		}
+	}
+}
@@ -2,4 +2,11 @@ package multicluster_gw
 
 // Ready implements the ready.Readiness interface, once this flips to true CoreDNS
 // assumes this plugin is ready for queries; it is not checked again.
-func (m MulticlusterGw) Ready() bool { return true }
+// We are ready once the ServiceImports of all the clusters were loaded, so we don't
+// answer NXDOMAIN for services that exist.
+func (m MulticlusterGw) Ready() bool {
+	if m.managers == nil {
+		return true
+	}
+	return m.managers.Ready()
+}
@@ -1,56 +1,105 @@
 package multicluster_gw
 
 import (
-	"flag"
+	"fmt"
 	"net"
-	"os"
-	"sync"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/tools/clientcmd"
 	ctrl "sigs.k8s.io/controller-runtime"
-	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
-	"sigs.k8s.io/controller-runtime/pkg/manager"
+	gatewayv1b1 "sigs.k8s.io/gateway-api/apis/v1beta1"
 	mcsv1a1 "sigs.k8s.io/mcs-api/pkg/apis/v1alpha1"
 )
 
 const pluginName = "multicluster_gw"
 
 var (
-	gateway_ip4 net.IP
-	gateway_ip6 net.IP
-	scheme      = runtime.NewScheme()
-	setupLog    = ctrl.Log.WithName("setup")
-	Mcgw        MulticlusterGw
+	scheme   = runtime.NewScheme()
+	setupLog = ctrl.Log.WithName("setup")
 )
 
 // init registers this plugin.
 func init() {
 	log.Debug("Started init function")
-	plugin.Register(pluginName, Mcgw.setup)
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(mcsv1a1.AddToScheme(scheme))
+	utilruntime.Must(gatewayv1b1.AddToScheme(scheme))
+	//+kubebuilder:scaffold:scheme
+
+	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+	plugin.Register(pluginName, setup)
 }
 
-// parse the corefile, setup the plugin with the given varibels and initialize controller
-func (Mcgw *MulticlusterGw) setup(c *caddy.Controller) error {
+// parse the corefile, setup the plugin with the given varibels and initialize controller.
+// Every server block gets its own plugin instance, with its own store of ServiceImports.
+func setup(c *caddy.Controller) error {
 	log.Info("Started setup function")
-	Mcgw.SISet.mutex = new(sync.RWMutex)
-	err := ParseStanza(c, Mcgw)
+	mcgw := &MulticlusterGw{Store: NewStore()}
+	err := ParseStanza(c, mcgw)
 	if err != nil {
 		return plugin.Error(pluginName, err)
 	}
 
-	initializeController()
+	if mcgw.snapshotFile != "" {
+		// the last known ServiceImports answer until the clusters sync, even if their API servers are down.
+		// A bad snapshot doesn't fail the setup, the clusters are the source of truth.
+		loaded, err := loadSnapshot(mcgw.snapshotFile, mcgw.Store, mcgw.Clusters)
+		if err != nil {
+			log.Warningf("Failed to load the snapshot file: %v", err)
+		} else if loaded > 0 {
+			log.Infof("Loaded %d ServiceImports from the snapshot file %s", loaded, mcgw.snapshotFile)
+		}
+	}
+
+	// the kubeconfigs are checked here, so a bad config fails the setup, but the managers are built and run
+	// only while the server runs, so the setup doesn't need the API servers. On reload they are stopped,
+	// and the new instance starts its own.
+	mcgw.managers = newClusterManagers(mcgw.Clusters, mcgw.Store)
+	mcgw.managers.syncTimeout, mcgw.managers.syncFail = mcgw.syncTimeout, mcgw.syncFail
+	mcgw.managers.gatewaySources, mcgw.managers.gateway = mcgw.gatewaySources, mcgw.gateway
+	mcgw.managers.stale = mcgw.stale
+	if mcgw.namespaceGateways.hasSelectors() {
+		mcgw.managers.namespaceGateways = mcgw.namespaceGateways
+	}
+	err = mcgw.managers.checkConfigs()
+	if err != nil {
+		return plugin.Error(pluginName, err)
+	}
+	c.OnStartup(mcgw.managers.Start)
+	c.OnRestart(mcgw.managers.Stop)
+	c.OnRestartFailed(mcgw.managers.Start)
+	c.OnShutdown(mcgw.managers.Stop)
+	if health := mcgw.gateway.health; health != nil {
+		c.OnStartup(health.Start)
+		c.OnRestart(health.Stop)
+		c.OnRestartFailed(health.Start)
+		c.OnShutdown(health.Stop)
+	}
+	if mcgw.snapshotFile != "" {
+		writer := newSnapshotWriter(mcgw.Store, mcgw.snapshotFile, mcgw.snapshotInterval)
+		c.OnStartup(writer.Start)
+		c.OnRestart(writer.Stop)
+		c.OnRestartFailed(writer.Start)
+		c.OnShutdown(writer.Stop)
+	}
 	log.Info("Finished initialize Controllere function")
 	// Add the Plugin to CoreDNS, so Servers can use it in their plugin chain.
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		Mcgw.Next = next
-		return Mcgw
+		mcgw.Next = next
+		return mcgw
 	})
 	log.Info("Finished register the Plugin")
 
@@ -65,126 +114,399 @@ func ParseStanza(c *caddy.Controller, mcgw *MulticlusterGw) error {
 
 	zones := plugin.OriginsFromArgsOrServerBlock(c.RemainingArgs(), c.ServerBlockKeys)
 	mcgw.New(zones)
+	gatewaySet := false
+	negativeTTLSet := false
+	// the interval and the timeout of the health checks, if they were given
+	healthTimes := []time.Duration{defaultHealthCheckInterval, defaultHealthCheckTimeout}
 
 	for c.NextBlock() {
 		switch c.Val() {
 		case "kubeconfig":
+			cluster, err := parseKubeconfig(c)
+			if err != nil {
+				return err
+			}
+			for _, other := range mcgw.Clusters {
+				if other.Name == cluster.Name {
+					return c.Errf("duplicate cluster name '%s'", cluster.Name)
+				}
+			}
+			mcgw.Clusters = append(mcgw.Clusters, cluster)
+
+		case "fallthrough":
+			mcgw.Fall.SetZonesFromArgs(c.RemainingArgs())
+
+		case "sync_timeout":
 			args := c.RemainingArgs()
 			if len(args) != 1 && len(args) != 2 {
 				return c.ArgErr()
 			}
-			overrides := &clientcmd.ConfigOverrides{}
+			timeout, err := time.ParseDuration(args[0])
+			if err != nil || timeout <= 0 {
+				return c.Errf("invalid sync_timeout '%s'", args[0])
+			}
+			mcgw.syncTimeout = timeout
 			if len(args) == 2 {
-				overrides.CurrentContext = args[1]
+				switch args[1] {
+				case "degraded":
+					mcgw.syncFail = false
+				case "fail":
+					mcgw.syncFail = true
+				default:
+					return c.Errf("unknown sync_timeout mode '%s', expected 'degraded' or 'fail'", args[1])
+				}
 			}
-			config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
-				&clientcmd.ClientConfigLoadingRules{ExplicitPath: args[0]},
-				overrides,
-			)
-			mcgw.ClientConfig = config
 
-		case "fallthrough":
-			mcgw.Fall.SetZonesFromArgs(c.RemainingArgs())
+		case "snapshot_file":
+			args := c.RemainingArgs()
+			if len(args) != 1 && len(args) != 2 {
+				return c.ArgErr()
+			}
+			mcgw.snapshotFile, mcgw.snapshotInterval = args[0], defaultSnapshotInterval
+			if len(args) == 2 {
+				interval, err := time.ParseDuration(args[1])
+				if err != nil || interval <= 0 {
+					return c.Errf("invalid snapshot_file interval '%s'", args[1])
+				}
+				mcgw.snapshotInterval = interval
+			}
+
+		case "max_stale":
+			args := c.RemainingArgs()
+			if len(args) != 1 && len(args) != 2 {
+				return c.ArgErr()
+			}
+			maxStale, err := time.ParseDuration(args[0])
+			if err != nil || maxStale <= 0 {
+				return c.Errf("invalid max_stale '%s'", args[0])
+			}
+			mcgw.maxStale = maxStale
+			if len(args) == 2 {
+				if !validStaleMode(args[1]) {
+					return c.Errf("unknown max_stale mode '%s', expected one of serve, servfail or fallthrough", args[1])
+				}
+				mcgw.staleMode = args[1]
+			}
+
+		case "clusterset_ip":
+			// without zones, the ClusterSetIPs are answered in all the zones of the plugin
+			mcgw.clusterSetIPZones = plugin.OriginsFromArgsOrServerBlock(c.RemainingArgs(), mcgw.Zones)
+
+		case "gateway_hostname":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			if _, ok := dns.IsDomainName(args[0]); !ok {
+				return c.Errf("invalid gateway_hostname '%s'", args[0])
+			}
+			mcgw.gatewayHostname = dns.Fqdn(args[0])
+
+		case "ttl", "negative_ttl":
+			directive := c.Val()
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			ttl, err := strconv.ParseUint(args[0], 10, 32)
+			if err != nil || ttl > maxTTL {
+				return c.Errf("invalid %s '%s', expected seconds between 0 and %d", directive, args[0], maxTTL)
+			}
+			if directive == "ttl" {
+				mcgw.ttl = uint32(ttl)
+			} else {
+				mcgw.negativeTTL = uint32(ttl)
+				negativeTTLSet = true
+			}
+
+		case "gateway_host":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			if _, ok := dns.IsDomainName(args[0]); !ok || net.ParseIP(args[0]) != nil {
+				return c.Errf("invalid gateway_host '%s'", args[0])
+			}
+			mcgw.gatewayHost = dns.Fqdn(args[0])
+
+		case "gateway_host_flatten":
+			mcgw.gatewayHostFlatten = true
+			for _, upstream := range c.RemainingArgs() {
+				server, err := parseUpstream(upstream)
+				if err != nil {
+					return c.Errf("invalid gateway_host_flatten upstream '%s'", upstream)
+				}
+				mcgw.gatewayHostUpstreams = append(mcgw.gatewayHostUpstreams, server)
+			}
 
 		case "gateway_ip":
-			mcgw.gatewayIp4, mcgw.gatewayIp6 = parseIp(c)
+			ip4, ip6, err := parseIps(c, "gateway_ip", c.RemainingArgs())
+			if err != nil {
+				return err
+			}
+			if !gatewaySet {
+				// the first gateway_ip replaces the default gateway, the next ones add to it
+				mcgw.gatewayIp4, mcgw.gatewayIp6 = nil, nil
+				gatewaySet = true
+			}
+			mcgw.gatewayIp4 = append(mcgw.gatewayIp4, ip4...)
+			mcgw.gatewayIp6 = append(mcgw.gatewayIp6, ip6...)
+
+		case "policy":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			if !validPolicy(args[0]) {
+				return c.Errf("unknown policy '%s', expected one of round_robin, random, weighted or all", args[0])
+			}
+			mcgw.gateway.policy = args[0]
+
+		case "gateway_weight":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return c.ArgErr()
+			}
+			ip := net.ParseIP(args[0])
+			if ip == nil {
+				return c.Errf("invalid gateway_weight address '%s'", args[0])
+			}
+			weight, err := strconv.Atoi(args[1])
+			if err != nil || weight < 0 {
+				return c.Errf("invalid gateway_weight '%s'", args[1])
+			}
+			mcgw.gateway.weights[ip.String()] = weight
+
+		case "gateway_service", "gateway_ref":
+			directive := c.Val()
+			kind := gatewaySourceService
+			if directive == "gateway_ref" {
+				kind = gatewaySourceGateway
+			}
+			source, err := parseGatewaySource(c, kind)
+			if err != nil {
+				return err
+			}
+			for _, other := range mcgw.gatewaySources {
+				if other == source {
+					return c.Errf("duplicate %s '%s'", directive, source.name)
+				}
+			}
+			mcgw.gatewaySources = append(mcgw.gatewaySources, source)
+
+		case "namespace_gateway", "namespace_selector_gateway":
+			gateway, err := parseNamespaceGateway(c)
+			if err != nil {
+				return err
+			}
+			if !mcgw.namespaceGateways.add(gateway) {
+				return c.Errf("duplicate namespace_gateway of namespace '%s'", gateway.namespace)
+			}
+
+		case "health_check":
+			probe, err := parseHealthCheck(c)
+			if err != nil {
+				return err
+			}
+			mcgw.gateway.health = newHealthChecker(probe, mcgw.probedAddresses)
+
+		case "health_check_interval":
+			args := c.RemainingArgs()
+			if len(args) != 1 && len(args) != 2 {
+				return c.ArgErr()
+			}
+			for i, arg := range args {
+				duration, err := time.ParseDuration(arg)
+				if err != nil || duration <= 0 {
+					return c.Errf("invalid health_check_interval '%s'", arg)
+				}
+				healthTimes[i] = duration
+			}
+
+		case "all_unhealthy":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			if !validAllDownMode(args[0]) {
+				return c.Errf("unknown all_unhealthy mode '%s', expected one of fallthrough, servfail or last_healthy", args[0])
+			}
+			mcgw.gateway.allDown = args[0]
 
 		default:
 			return c.Errf("unknown property '%s'", c.Val())
 		}
 	}
+	if !negativeTTLSet {
+		// the negative answers are cached like the positive ones
+		mcgw.negativeTTL = mcgw.ttl
+	}
+	if mcgw.gatewayHost != "" {
+		if gatewaySet || len(mcgw.gatewaySources) > 0 {
+			return c.Errf("gateway_host can't be used with gateway_ip, gateway_service or gateway_ref")
+		}
+		// the gateway is given by name, there is no default gateway
+		mcgw.gatewayIp4, mcgw.gatewayIp6 = nil, nil
+	} else if mcgw.gatewayHostFlatten {
+		return c.Errf("gateway_host_flatten without gateway_host")
+	}
+	if len(mcgw.gatewaySources) > 0 && !gatewaySet {
+		// the gateway addresses are discovered, there is no default gateway
+		mcgw.gatewayIp4, mcgw.gatewayIp6 = nil, nil
+	}
+	// with gateway sources, the weight may be of an address that will be discovered
+	if len(mcgw.gatewaySources) == 0 {
+		for ipAsString := range mcgw.gateway.weights {
+			ip := net.ParseIP(ipAsString)
+			if !containsIP(mcgw.probedAddresses(), ip) {
+				return c.Errf("gateway_weight of '%s', which isn't a gateway_ip", ipAsString)
+			}
+		}
+	}
+	if health := mcgw.gateway.health; health != nil {
+		health.interval, health.timeout = healthTimes[0], healthTimes[1]
+	}
+	if len(mcgw.Clusters) == 0 {
+		// no kubeconfig was given, watch the cluster we are running in:
+		mcgw.Clusters = append(mcgw.Clusters, Cluster{Name: defaultClusterName})
+	}
 	log.Info("Finish to parse Stanza")
 
 	return nil
 }
 
-// parse the Ip given as caddy.Controller arg, as a string, to ipv4 and ipv6 format
-func parseIp(c *caddy.Controller) (net.IP, net.IP) {
-	ipAsString := c.RemainingArgs()[0]
-	ip := net.ParseIP(ipAsString)
-	if ip == nil {
-		//The ip was given as string, not a number
-		return nil, nil
-	} else {
-		return ip.To4(), ip.To16()
+// parse a 'kubeconfig KUBECONFIG [CONTEXT] [cluster NAME]' line to the cluster it describes.
+// If no name is given, the context (or the kubeconfig path, if there is no context) is used as the cluster name.
+func parseKubeconfig(c *caddy.Controller) (Cluster, error) {
+	args := c.RemainingArgs()
+	name := ""
+	if len(args) > 2 && args[len(args)-2] == "cluster" {
+		name = args[len(args)-1]
+		args = args[:len(args)-2]
+	}
+	if len(args) != 1 && len(args) != 2 {
+		return Cluster{}, c.ArgErr()
+	}
+	overrides := &clientcmd.ConfigOverrides{}
+	if len(args) == 2 {
+		overrides.CurrentContext = args[1]
 	}
+	if name == "" {
+		name = args[len(args)-1]
+	}
+	config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: args[0]},
+		overrides,
+	)
+	return Cluster{Name: name, ClientConfig: config}, nil
 }
 
-// function to initalizeController, mostly copied from the 'main' that kubebuilder gives to controllers
-func initializeController() {
-	log.Info("Started to initialize Controller")
-	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
-	utilruntime.Must(mcsv1a1.AddToScheme(scheme))
-	//+kubebuilder:scaffold:scheme
-
-	var metricsAddr string
-	var enableLeaderElection bool
-	var probeAddr string
-	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8081", "The address the metric endpoint binds to.")
-	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8082", "The address the probe endpoint binds to.")
-	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
-		"Enable leader election for controller manager. "+
-			"Enabling this will ensure there is only one active controller manager.")
-	opts := zap.Options{
-		Development: true,
-	}
-	opts.BindFlags(flag.CommandLine)
-	flag.Parse()
-
-	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
-
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:                 scheme,
-		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
-		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "ecaf1259.my.domain",
-		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
-		// when the Manager ends. This requires the binary to immediately end when the
-		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
-		// speeds up voluntary leader transitions as the new leader don't have to wait
-		// LeaseDuration time first.
-		//
-		// In the default scaffold provided, the program ends immediately after
-		// the manager stops, so would be fine to enable this option. However,
-		// if you are doing or is intended to do any operation such as perform cleanups
-		// after the manager stops then its usage might be unsafe.
-		// LeaderElectionReleaseOnCancel: true,
-	})
-	if err != nil {
-		setupLog.Error(err, "unable to start manager")
-		os.Exit(1)
+// parse the Ips given as caddy.Controller args, as strings, to the ipv4 and the ipv6 ones
+func parseIps(c *caddy.Controller, directive string, args []string) ([]net.IP, []net.IP, error) {
+	if len(args) == 0 {
+		return nil, nil, c.ArgErr()
+	}
+	var ip4, ip6 []net.IP
+	for _, ipAsString := range args {
+		ip := net.ParseIP(ipAsString)
+		if ip == nil {
+			if directive == "gateway_ip" {
+				return nil, nil, c.Errf("invalid gateway_ip '%s' (use gateway_host for a gateway that has a name)", ipAsString)
+			}
+			return nil, nil, c.Errf("invalid %s '%s'", directive, ipAsString)
+		}
+		if ip.To4() != nil {
+			ip4 = append(ip4, ip.To4())
+		} else {
+			ip6 = append(ip6, ip)
+		}
 	}
+	return ip4, ip6, nil
+}
 
-	if err = (&ServiceImportReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "ServiceImportController")
-		os.Exit(1)
+// parse a 'health_check tcp PORT' or a 'health_check http PORT [PATH]' line to the probe it describes.
+func parseHealthCheck(c *caddy.Controller) (probeFunc, error) {
+	args := c.RemainingArgs()
+	if len(args) < 2 {
+		return nil, c.ArgErr()
 	}
-	//+kubebuilder:scaffold:builder
-	/* don't need to healthCheck, already happens in coredns
-	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
-		setupLog.Error(err, "unable to set up health check")
-		os.Exit(1)
+	port, err := strconv.Atoi(args[1])
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, c.Errf("invalid health_check port '%s'", args[1])
 	}
-	*/
-	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
-		setupLog.Error(err, "unable to set up ready check")
-		os.Exit(1)
+	switch args[0] {
+	case "tcp":
+		if len(args) != 2 {
+			return nil, c.ArgErr()
+		}
+		return tcpProbe(args[1]), nil
+	case "http":
+		if len(args) > 3 {
+			return nil, c.ArgErr()
+		}
+		path := "/"
+		if len(args) == 3 {
+			path = args[2]
+		}
+		if !strings.HasPrefix(path, "/") {
+			return nil, c.Errf("invalid health_check path '%s'", path)
+		}
+		return httpProbe(args[1], path), nil
 	}
+	return nil, c.Errf("unknown health_check protocol '%s', expected tcp or http", args[0])
+}
 
-	setupLog.Info("starting manager")
+// parse a 'gateway_service NAMESPACE/NAME' or a 'gateway_ref NAMESPACE/NAME' line to the source it describes.
+func parseGatewaySource(c *caddy.Controller, kind string) (gatewaySource, error) {
+	directive := c.Val()
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return gatewaySource{}, c.ArgErr()
+	}
+	parts := strings.Split(args[0], "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return gatewaySource{}, c.Errf("invalid %s '%s', expected NAMESPACE/NAME", directive, args[0])
+	}
+	return gatewaySource{kind: kind, name: types.NamespacedName{Namespace: parts[0], Name: parts[1]}}, nil
+}
 
-	go activateManager(mgr)
+// parse a 'namespace_gateway NAMESPACE IP...' or a 'namespace_selector_gateway SELECTOR IP...' line
+// to the gateway it describes.
+func parseNamespaceGateway(c *caddy.Controller) (namespaceGateway, error) {
+	directive := c.Val()
+	args := c.RemainingArgs()
+	if len(args) < 2 {
+		return namespaceGateway{}, c.ArgErr()
+	}
+	var gateway namespaceGateway
+	if directive == "namespace_selector_gateway" {
+		selector, err := labels.Parse(args[0])
+		if err != nil {
+			return namespaceGateway{}, c.Errf("invalid namespace_selector_gateway selector '%s': %v", args[0], err)
+		}
+		gateway.selector = selector
+	} else {
+		if errs := validation.IsDNS1123Label(args[0]); len(errs) > 0 {
+			return namespaceGateway{}, c.Errf("invalid namespace_gateway namespace '%s'", args[0])
+		}
+		gateway.namespace = args[0]
+	}
+	var err error
+	gateway.ip4, gateway.ip6, err = parseIps(c, directive+" ip", args[1:])
+	return gateway, err
 }
 
-// fucntion to activate the manager, splitted to a different func to do in a seperate go routine
-func activateManager(mgr manager.Manager) {
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
-		setupLog.Error(err, "problem running manager")
-		os.Exit(1)
+// parse an upstream server, an IP with an optional port (53 by default), to its host:port.
+func parseUpstream(upstream string) (string, error) {
+	host, port, err := net.SplitHostPort(upstream)
+	if err != nil {
+		host, port = upstream, "53"
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid upstream address '%s'", host)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("invalid upstream port '%s'", port)
 	}
+	return net.JoinHostPort(host, port), nil
 }
@@ -2,33 +2,37 @@ package multicluster_gw
 
 import (
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/plugin/pkg/fall"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 // TestSetup tests the various things that should be parsed by setup.
 func TestSetup(t *testing.T) {
 
 	tests := []struct {
-		input               string // Corefile data as string
-		shouldErr           bool   // true if test case is expected to produce an error.
-		expectedErrContent  string // substring from the expected error. Empty for positive cases.
-		expectedZoneCount   int    // expected count of defined zones.
-		expectedGatewayIp4  net.IP // expected value of gateway ip in IP4 format.
-		expectedGatewayIp6  net.IP // expected value of gateway ip in IP6 format.
-		expectedFallthrough fall.F // expected value of fallthourgh setting.
+		input               string   // Corefile data as string
+		shouldErr           bool     // true if test case is expected to produce an error.
+		expectedErrContent  string   // substring from the expected error. Empty for positive cases.
+		expectedZoneCount   int      // expected count of defined zones.
+		expectedGatewayIp4  []net.IP // expected value of the gateway IPv4 addresses.
+		expectedGatewayIp6  []net.IP // expected value of the gateway IPv6 addresses.
+		expectedFallthrough fall.F   // expected value of fallthourgh setting.
 	}{
 		{
 			`multicluster_gw .svc.clusterset.local.`,
 			false,
 			"",
 			1,
-			defaultGwIpv4,
-			defaultGwIpv6,
+			[]net.IP{defaultGwIpv4},
+			nil,
 			fall.Zero,
 		},
 		{
@@ -36,8 +40,8 @@ func TestSetup(t *testing.T) {
 			false,
 			"",
 			2,
-			defaultGwIpv4,
-			defaultGwIpv6,
+			[]net.IP{defaultGwIpv4},
+			nil,
 			fall.Zero,
 		},
 		{
@@ -47,8 +51,8 @@ func TestSetup(t *testing.T) {
 			false,
 			"",
 			2,
-			defaultGwIpv4,
-			defaultGwIpv6,
+			[]net.IP{defaultGwIpv4},
+			nil,
 			fall.Root,
 		},
 		{
@@ -58,8 +62,53 @@ func TestSetup(t *testing.T) {
 			false,
 			"",
 			2,
-			net.IPv4(6, 6, 6, 6),
-			net.IPv4(6, 6, 6, 6).To16(),
+			[]net.IP{net.IPv4(6, 6, 6, 6).To4()},
+			nil,
+			fall.Zero,
+		},
+		{
+			`multicluster_gw .svc.clusterset.local. {
+    gateway_ip 6.6.6.6 fd00::6 7.7.7.7
+    gateway_ip fd00::7
+}`,
+			false,
+			"",
+			1,
+			[]net.IP{net.IPv4(6, 6, 6, 6).To4(), net.IPv4(7, 7, 7, 7).To4()},
+			[]net.IP{net.ParseIP("fd00::6"), net.ParseIP("fd00::7")},
+			fall.Zero,
+		},
+		{
+			`multicluster_gw .svc.clusterset.local. {
+    gateway_ip fd00::6
+}`,
+			false,
+			"",
+			1,
+			nil,
+			[]net.IP{net.ParseIP("fd00::6")},
+			fall.Zero,
+		},
+		{
+			`multicluster_gw .svc.clusterset.local. {
+    gateway_ip 6.6.6
+}`,
+			true,
+			"invalid gateway_ip",
+			-1,
+			nil,
+			nil,
+			fall.Zero,
+		},
+		{
+			`multicluster_gw .svc.clusterset.local. {
+    gateway_ip
+}`,
+			true,
+			"Wrong argument count",
+			-1,
+			nil,
+			nil,
 			fall.Zero,
 		},
 	}
@@ -72,10 +121,10 @@ func TestSetup(t *testing.T) {
 		4. check for the value of the ip of gateway, and if configed correctly
 	*/
 	for i, test := range tests {
-		// init the Mcgw as a new, empty one:
-		Mcgw = MulticlusterGw{}
+		// init the mcgw as a new, empty one:
+		mcgw := MulticlusterGw{}
 		c := caddy.NewTestController("dns", test.input)
-		err := ParseStanza(c, &Mcgw)
+		err := ParseStanza(c, &mcgw)
 
 		if test.shouldErr && err == nil {
 			t.Errorf("Test %d: Expected error, but did not find error for input '%s'. Error was: '%v'", i, test.input, err)
@@ -102,22 +151,1017 @@ func TestSetup(t *testing.T) {
 		}
 
 		// No error was raised, so validate initialization of k8sController
-		foundZoneCount := len(Mcgw.Zones)
+		foundZoneCount := len(mcgw.Zones)
 		if foundZoneCount != test.expectedZoneCount {
-			t.Errorf("Test %d: Expected kubernetes controller to be initialized with %d zones, instead found %d zones: '%v' for input '%s'", i, test.expectedZoneCount, foundZoneCount, Mcgw.Zones, test.input)
+			t.Errorf("Test %d: Expected kubernetes controller to be initialized with %d zones, instead found %d zones: '%v' for input '%s'", i, test.expectedZoneCount, foundZoneCount, mcgw.Zones, test.input)
 		}
 
 		// fallthrough
-		if !Mcgw.Fall.Equal(test.expectedFallthrough) {
-			t.Errorf("Test %d: Expected kubernetes controller to be initialized with fallthrough '%v'. Instead found fallthrough '%v' for input '%s'", i, test.expectedFallthrough, Mcgw.Fall, test.input)
+		if !mcgw.Fall.Equal(test.expectedFallthrough) {
+			t.Errorf("Test %d: Expected kubernetes controller to be initialized with fallthrough '%v'. Instead found fallthrough '%v' for input '%s'", i, test.expectedFallthrough, mcgw.Fall, test.input)
 		}
 
 		// gateway
-		if !reflect.DeepEqual(Mcgw.gatewayIp4.To16(), test.expectedGatewayIp4) {
-			t.Errorf("Test %d: Expected kubernetes controller to be initialized with gateway Ip4 of '%v'. Instead found gateway Ip4 of '%v' for input '%s'", i, test.expectedGatewayIp4, Mcgw.gatewayIp4, test.input)
+		if !reflect.DeepEqual(mcgw.gatewayIp4, test.expectedGatewayIp4) {
+			t.Errorf("Test %d: Expected kubernetes controller to be initialized with gateway Ip4 of '%v'. Instead found gateway Ip4 of '%v' for input '%s'", i, test.expectedGatewayIp4, mcgw.gatewayIp4, test.input)
+		}
+		if !reflect.DeepEqual(mcgw.gatewayIp6, test.expectedGatewayIp6) {
+			t.Errorf("Test %d: Expected kubernetes controller to be initialized with gateway Ip6 of '%v'. Instead found gateway Ip6 of '%v' for input '%s'", i, test.expectedGatewayIp6, mcgw.gatewayIp6, test.input)
+		}
+	}
+}
+
+// TestGetClientConfig tests that the kubeconfig given in the corefile is the one used to build the rest config.
+func TestGetClientConfig(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	err := os.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: remote
+  cluster:
+    server: https://remote.example.com:6443
+contexts:
+- name: remote
+  context:
+    cluster: remote
+current-context: remote
+`), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write kubeconfig: %v", err)
+	}
+
+	tests := []struct {
+		input              string // Corefile data as string
+		shouldErr          bool   // true if test case is expected to produce an error.
+		expectedErrContent string // substring from the expected error. Empty for positive cases.
+		expectedHost       string // expected api server of the loaded config.
+	}{
+		{
+			`multicluster_gw svc.clusterset.local. {
+    kubeconfig ` + kubeconfig + `
+}`,
+			false,
+			"",
+			"https://remote.example.com:6443",
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    kubeconfig ` + kubeconfig + ` remote
+}`,
+			false,
+			"",
+			"https://remote.example.com:6443",
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    kubeconfig ` + kubeconfig + ` missing-context
+}`,
+			true,
+			"unable to load kubeconfig",
+			"",
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    kubeconfig /does/not/exist
+}`,
+			true,
+			"unable to load kubeconfig",
+			"",
+		},
+	}
+
+	for i, test := range tests {
+		mcgw := MulticlusterGw{}
+		c := caddy.NewTestController("dns", test.input)
+		if err := ParseStanza(c, &mcgw); err != nil {
+			t.Fatalf("Test %d: Expected no error from ParseStanza but found one for input %s. Error was: %v", i, test.input, err)
+		}
+
+		cfg, err := mcgw.Clusters[0].getClientConfig()
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but did not find error for input '%s'", i, test.input)
+			} else if !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: Expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v", i, test.input, err)
+			continue
+		}
+		if cfg.Host != test.expectedHost {
+			t.Errorf("Test %d: Expected config host '%s', instead found '%s' for input '%s'", i, test.expectedHost, cfg.Host, test.input)
+		}
+	}
+}
+
+// TestSetupClusters tests the parsing of the clusters the plugin watches.
+func TestSetupClusters(t *testing.T) {
+	tests := []struct {
+		input              string   // Corefile data as string
+		shouldErr          bool     // true if test case is expected to produce an error.
+		expectedErrContent string   // substring from the expected error. Empty for positive cases.
+		expectedClusters   []string // expected names of the watched clusters.
+	}{
+		{
+			`multicluster_gw svc.clusterset.local.`,
+			false,
+			"",
+			[]string{defaultClusterName},
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    kubeconfig /etc/kubeconfig east
+    kubeconfig /etc/kubeconfig west
+}`,
+			false,
+			"",
+			[]string{"east", "west"},
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    kubeconfig /etc/east.kubeconfig cluster c1
+    kubeconfig /etc/west.kubeconfig admin cluster c2
+}`,
+			false,
+			"",
+			[]string{"c1", "c2"},
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    kubeconfig /etc/east.kubeconfig admin
+    kubeconfig /etc/west.kubeconfig admin
+}`,
+			true,
+			"duplicate cluster name",
+			nil,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    kubeconfig
+}`,
+			true,
+			"Wrong argument count",
+			nil,
+		},
+	}
+
+	for i, test := range tests {
+		mcgw := MulticlusterGw{}
+		c := caddy.NewTestController("dns", test.input)
+		err := ParseStanza(c, &mcgw)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but did not find error for input '%s'", i, test.input)
+			} else if !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: Expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v", i, test.input, err)
+			continue
+		}
+
+		names := make([]string, 0, len(mcgw.Clusters))
+		for _, cluster := range mcgw.Clusters {
+			names = append(names, cluster.Name)
+		}
+		if !reflect.DeepEqual(names, test.expectedClusters) {
+			t.Errorf("Test %d: Expected clusters %v, instead found %v for input '%s'", i, test.expectedClusters, names, test.input)
+		}
+	}
+}
+
+// TestSetupSyncTimeout tests the parsing of the sync_timeout directive.
+func TestSetupSyncTimeout(t *testing.T) {
+	tests := []struct {
+		input               string        // Corefile data as string
+		shouldErr           bool          // true if test case is expected to produce an error.
+		expectedErrContent  string        // substring from the expected error. Empty for positive cases.
+		expectedSyncTimeout time.Duration // expected sync timeout.
+		expectedSyncFail    bool          // expected sync timeout mode.
+	}{
+		{
+			`multicluster_gw svc.clusterset.local.`,
+			false,
+			"",
+			0,
+			false,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    sync_timeout 30s
+}`,
+			false,
+			"",
+			30 * time.Second,
+			false,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    sync_timeout 1m fail
+}`,
+			false,
+			"",
+			time.Minute,
+			true,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    sync_timeout 1m degraded
+}`,
+			false,
+			"",
+			time.Minute,
+			false,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    sync_timeout soon
+}`,
+			true,
+			"invalid sync_timeout",
+			0,
+			false,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    sync_timeout 1m never
+}`,
+			true,
+			"unknown sync_timeout mode",
+			0,
+			false,
+		},
+	}
+
+	for i, test := range tests {
+		mcgw := MulticlusterGw{}
+		c := caddy.NewTestController("dns", test.input)
+		err := ParseStanza(c, &mcgw)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but did not find error for input '%s'", i, test.input)
+			} else if !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: Expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v", i, test.input, err)
+			continue
+		}
+		if mcgw.syncTimeout != test.expectedSyncTimeout || mcgw.syncFail != test.expectedSyncFail {
+			t.Errorf("Test %d: Expected sync timeout %v (fail: %v), instead found %v (fail: %v) for input '%s'", i, test.expectedSyncTimeout, test.expectedSyncFail, mcgw.syncTimeout, mcgw.syncFail, test.input)
+		}
+	}
+}
+
+// TestSetupClusterSetIP tests the parsing of the clusterset_ip directive.
+func TestSetupClusterSetIP(t *testing.T) {
+	tests := []struct {
+		input         string   // Corefile data as string
+		expectedZones []string // expected zones of the ClusterSetIP mode.
+	}{
+		{
+			`multicluster_gw svc.clusterset.local. other.local.`,
+			nil,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. other.local. {
+    clusterset_ip
+}`,
+			[]string{"svc.clusterset.local.", "other.local."},
+		},
+		{
+			`multicluster_gw svc.clusterset.local. other.local. {
+    clusterset_ip other.local
+}`,
+			[]string{"other.local."},
+		},
+	}
+
+	for i, test := range tests {
+		mcgw := MulticlusterGw{}
+		c := caddy.NewTestController("dns", test.input)
+		if err := ParseStanza(c, &mcgw); err != nil {
+			t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v", i, test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(mcgw.clusterSetIPZones, test.expectedZones) {
+			t.Errorf("Test %d: Expected ClusterSetIP zones %v, instead found %v for input '%s'", i, test.expectedZones, mcgw.clusterSetIPZones, test.input)
+		}
+	}
+}
+
+// TestSetupGatewayPolicy tests the parsing of the gateway policy and weights.
+func TestSetupGatewayPolicy(t *testing.T) {
+	tests := []struct {
+		input              string         // Corefile data as string
+		expectedErrContent string         // substring from the expected error. Empty for positive cases.
+		expectedPolicy     string         // expected policy of the gateway.
+		expectedWeights    map[string]int // expected weights of the gateway addresses.
+	}{
+		{
+			`multicluster_gw svc.clusterset.local.`,
+			"",
+			policyAll,
+			map[string]int{},
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    gateway_ip 6.6.6.6 7.7.7.7 fd00::6
+    policy weighted
+    gateway_weight 6.6.6.6 3
+    gateway_weight fd00:0::6 0
+}`,
+			"",
+			policyWeighted,
+			map[string]int{"6.6.6.6": 3, "fd00::6": 0},
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    policy round_robin
+}`,
+			"",
+			policyRoundRobin,
+			map[string]int{},
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    policy first
+}`,
+			"unknown policy",
+			"",
+			nil,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    gateway_weight 6.6.6.6 -1
+}`,
+			"invalid gateway_weight",
+			"",
+			nil,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    gateway_ip 6.6.6.6
+    gateway_weight 7.7.7.7 2
+}`,
+			"isn't a gateway_ip",
+			"",
+			nil,
+		},
+	}
+
+	for i, test := range tests {
+		mcgw := MulticlusterGw{}
+		c := caddy.NewTestController("dns", test.input)
+		err := ParseStanza(c, &mcgw)
+		if test.expectedErrContent != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: Expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v", i, test.input, err)
+			continue
+		}
+		if mcgw.gateway.policy != test.expectedPolicy {
+			t.Errorf("Test %d: Expected policy %s, instead found %s for input '%s'", i, test.expectedPolicy, mcgw.gateway.policy, test.input)
+		}
+		if !reflect.DeepEqual(mcgw.gateway.weights, test.expectedWeights) {
+			t.Errorf("Test %d: Expected weights %v, instead found %v for input '%s'", i, test.expectedWeights, mcgw.gateway.weights, test.input)
+		}
+	}
+}
+
+// TestSetupHealthCheck tests the parsing of the health checks of the gateway.
+func TestSetupHealthCheck(t *testing.T) {
+	tests := []struct {
+		input              string        // Corefile data as string
+		expectedErrContent string        // substring from the expected error. Empty for positive cases.
+		expectedHealth     bool          // expected to health check the gateway.
+		expectedInterval   time.Duration // expected interval of the health checks.
+		expectedTimeout    time.Duration // expected timeout of a single probe.
+		expectedAllDown    string        // expected mode of answering when all the gateway is unhealthy.
+	}{
+		{
+			`multicluster_gw svc.clusterset.local.`,
+			"",
+			false,
+			0,
+			0,
+			allDownLastHealthy,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    health_check tcp 443
+}`,
+			"",
+			true,
+			defaultHealthCheckInterval,
+			defaultHealthCheckTimeout,
+			allDownLastHealthy,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    health_check_interval 10s 1s
+    health_check http 8080 /healthz
+    all_unhealthy servfail
+}`,
+			"",
+			true,
+			10 * time.Second,
+			time.Second,
+			allDownServfail,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    health_check udp 53
+}`,
+			"unknown health_check protocol",
+			false,
+			0,
+			0,
+			"",
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    health_check tcp https
+}`,
+			"invalid health_check port",
+			false,
+			0,
+			0,
+			"",
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    health_check http 80 healthz
+}`,
+			"invalid health_check path",
+			false,
+			0,
+			0,
+			"",
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    health_check_interval 0s
+}`,
+			"invalid health_check_interval",
+			false,
+			0,
+			0,
+			"",
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    all_unhealthy nxdomain
+}`,
+			"unknown all_unhealthy mode",
+			false,
+			0,
+			0,
+			"",
+		},
+	}
+
+	for i, test := range tests {
+		mcgw := MulticlusterGw{}
+		c := caddy.NewTestController("dns", test.input)
+		err := ParseStanza(c, &mcgw)
+		if test.expectedErrContent != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: Expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v", i, test.input, err)
+			continue
+		}
+		health := mcgw.gateway.health
+		if (health != nil) != test.expectedHealth {
+			t.Errorf("Test %d: Expected health checks %v, instead found %v for input '%s'", i, test.expectedHealth, health != nil, test.input)
+			continue
+		}
+		if health != nil && (health.interval != test.expectedInterval || health.timeout != test.expectedTimeout) {
+			t.Errorf("Test %d: Expected interval %v and timeout %v, instead found %v and %v for input '%s'", i, test.expectedInterval, test.expectedTimeout, health.interval, health.timeout, test.input)
+		}
+		if mcgw.gateway.allDown != test.expectedAllDown {
+			t.Errorf("Test %d: Expected all_unhealthy mode %s, instead found %s for input '%s'", i, test.expectedAllDown, mcgw.gateway.allDown, test.input)
+		}
+	}
+}
+
+// TestSetupGatewaySources tests the parsing of the resources the gateway addresses are discovered from.
+func TestSetupGatewaySources(t *testing.T) {
+	tests := []struct {
+		input              string          // Corefile data as string
+		expectedErrContent string          // substring from the expected error. Empty for positive cases.
+		expectedSources    []gatewaySource // expected gateway sources.
+		expectedGatewayIp4 []net.IP        // expected value of the configured gateway IPv4 addresses.
+	}{
+		{
+			`multicluster_gw svc.clusterset.local. {
+    gateway_service gw-ns/gw-lb
+    gateway_ref gw-ns/gw
+}`,
+			"",
+			[]gatewaySource{
+				{gatewaySourceService, types.NamespacedName{Namespace: "gw-ns", Name: "gw-lb"}},
+				{gatewaySourceGateway, types.NamespacedName{Namespace: "gw-ns", Name: "gw"}},
+			},
+			nil,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    gateway_ip 6.6.6.6
+    gateway_ref gw-ns/gw
+    gateway_weight 7.7.7.7 0
+}`,
+			"",
+			[]gatewaySource{{gatewaySourceGateway, types.NamespacedName{Namespace: "gw-ns", Name: "gw"}}},
+			[]net.IP{net.IPv4(6, 6, 6, 6).To4()},
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    gateway_service gw-lb
+}`,
+			"invalid gateway_service 'gw-lb', expected NAMESPACE/NAME",
+			nil,
+			nil,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    gateway_ref gw-ns/
+}`,
+			"invalid gateway_ref 'gw-ns/', expected NAMESPACE/NAME",
+			nil,
+			nil,
+		},
+		// without gateway sources, the weights must be of the gateway_ip addresses:
+		{
+			`multicluster_gw svc.clusterset.local. {
+    gateway_ip 6.6.6.6
+    gateway_weight 7.7.7.7 0
+}`,
+			"gateway_weight of '7.7.7.7', which isn't a gateway_ip",
+			nil,
+			nil,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    gateway_ref gw-ns/gw
+    gateway_ref gw-ns/gw
+}`,
+			"duplicate gateway_ref 'gw-ns/gw'",
+			nil,
+			nil,
+		},
+	}
+
+	for i, test := range tests {
+		mcgw := MulticlusterGw{}
+		c := caddy.NewTestController("dns", test.input)
+		err := ParseStanza(c, &mcgw)
+		if test.expectedErrContent != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: Expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v", i, test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(mcgw.gatewaySources, test.expectedSources) {
+			t.Errorf("Test %d: Expected gateway sources %v, instead found %v for input '%s'", i, test.expectedSources, mcgw.gatewaySources, test.input)
+		}
+		if !reflect.DeepEqual(mcgw.gatewayIp4, test.expectedGatewayIp4) {
+			t.Errorf("Test %d: Expected gateway ips %v, instead found %v for input '%s'", i, test.expectedGatewayIp4, mcgw.gatewayIp4, test.input)
+		}
+	}
+}
+
+// TestSetupNamespaceGateway tests the parsing of the gateways of the namespaces.
+func TestSetupNamespaceGateway(t *testing.T) {
+	tests := []struct {
+		input              string // Corefile data as string
+		expectedErrContent string // substring from the expected error. Empty for positive cases.
+		expectedGateways   int    // expected count of the namespace gateways.
+		expectedSelectors  bool   // expected to have gateways by selector.
+	}{
+		{
+			`multicluster_gw svc.clusterset.local. {
+    namespace_gateway tenant-a 6.6.6.6 fd00::6
+    namespace_gateway tenant-b 7.7.7.7
+}`,
+			"",
+			2,
+			false,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    namespace_gateway tenant-a 6.6.6.6
+    namespace_selector_gateway tenant=b,tier!=infra 7.7.7.7
+}`,
+			"",
+			2,
+			true,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    namespace_gateway tenant-a
+}`,
+			"Wrong argument count",
+			0,
+			false,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    namespace_gateway tenant-a 6.6.6
+}`,
+			"invalid namespace_gateway ip",
+			0,
+			false,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    namespace_gateway Tenant_A 6.6.6.6
+}`,
+			"invalid namespace_gateway namespace",
+			0,
+			false,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    namespace_selector_gateway tenant=(b 7.7.7.7
+}`,
+			"invalid namespace_selector_gateway selector",
+			0,
+			false,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    namespace_gateway tenant-a 6.6.6.6
+    namespace_gateway tenant-a 7.7.7.7
+}`,
+			"duplicate namespace_gateway",
+			0,
+			false,
+		},
+	}
+
+	for i, test := range tests {
+		mcgw := MulticlusterGw{}
+		c := caddy.NewTestController("dns", test.input)
+		err := ParseStanza(c, &mcgw)
+		if test.expectedErrContent != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: Expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v", i, test.input, err)
+			continue
+		}
+		if len(mcgw.namespaceGateways.gateways) != test.expectedGateways {
+			t.Errorf("Test %d: Expected %d namespace gateways, instead found %d for input '%s'", i, test.expectedGateways, len(mcgw.namespaceGateways.gateways), test.input)
+		}
+		if mcgw.namespaceGateways.hasSelectors() != test.expectedSelectors {
+			t.Errorf("Test %d: Expected selectors %v for input '%s'", i, test.expectedSelectors, test.input)
+		}
+	}
+}
+
+// TestSetupGatewayHost tests the parsing of a gateway that is given by name.
+func TestSetupGatewayHost(t *testing.T) {
+	tests := []struct {
+		input              string   // Corefile data as string
+		expectedErrContent string   // substring from the expected error. Empty for positive cases.
+		expectedHost       string   // expected name of the gateway.
+		expectedFlatten    bool     // expected to flatten the name.
+		expectedUpstreams  []string // expected upstreams to resolve the name with.
+	}{
+		{
+			`multicluster_gw svc.clusterset.local. {
+    gateway_host lb.example.com
+}`,
+			"",
+			"lb.example.com.",
+			false,
+			nil,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    gateway_host lb.example.com.
+    gateway_host_flatten
+}`,
+			"",
+			"lb.example.com.",
+			true,
+			nil,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    gateway_host lb.example.com
+    gateway_host_flatten 10.0.0.10 10.0.0.11:5353 [fd00::10]:53
+}`,
+			"",
+			"lb.example.com.",
+			true,
+			[]string{"10.0.0.10:53", "10.0.0.11:5353", "[fd00::10]:53"},
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    gateway_ip lb.example.com
+}`,
+			"use gateway_host",
+			"",
+			false,
+			nil,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    gateway_host lb.example.com
+    gateway_ip 6.6.6.6
+}`,
+			"can't be used with gateway_ip",
+			"",
+			false,
+			nil,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    gateway_host_flatten
+}`,
+			"without gateway_host",
+			"",
+			false,
+			nil,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    gateway_host lb.example.com
+    gateway_host_flatten dns.example.com
+}`,
+			"invalid gateway_host_flatten upstream",
+			"",
+			false,
+			nil,
+		},
+	}
+
+	for i, test := range tests {
+		mcgw := MulticlusterGw{}
+		c := caddy.NewTestController("dns", test.input)
+		err := ParseStanza(c, &mcgw)
+		if test.expectedErrContent != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: Expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v", i, test.input, err)
+			continue
+		}
+		if mcgw.gatewayHost != test.expectedHost || mcgw.gatewayHostFlatten != test.expectedFlatten {
+			t.Errorf("Test %d: Expected gateway host %s (flatten %v), instead found %s (flatten %v) for input '%s'", i, test.expectedHost, test.expectedFlatten, mcgw.gatewayHost, mcgw.gatewayHostFlatten, test.input)
+		}
+		if !reflect.DeepEqual(mcgw.gatewayHostUpstreams, test.expectedUpstreams) {
+			t.Errorf("Test %d: Expected upstreams %v, instead found %v for input '%s'", i, test.expectedUpstreams, mcgw.gatewayHostUpstreams, test.input)
+		}
+		if len(mcgw.gatewayIp4) != 0 {
+			t.Errorf("Test %d: Expected no gateway ips, instead found %v for input '%s'", i, mcgw.gatewayIp4, test.input)
+		}
+	}
+}
+
+// TestSetupTTL tests the parsing of the TTLs of the answers.
+func TestSetupTTL(t *testing.T) {
+	tests := []struct {
+		input               string // Corefile data as string
+		expectedErrContent  string // substring from the expected error. Empty for positive cases.
+		expectedTTL         uint32 // expected TTL of the answers.
+		expectedNegativeTTL uint32 // expected TTL of the negative answers.
+	}{
+		{
+			`multicluster_gw svc.clusterset.local.`,
+			"",
+			defaultTTL,
+			defaultTTL,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    ttl 30
+}`,
+			"",
+			30,
+			30,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    negative_ttl 60
+    ttl 0
+}`,
+			"",
+			0,
+			60,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    ttl 3601
+}`,
+			"invalid ttl",
+			0,
+			0,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    negative_ttl -1
+}`,
+			"invalid negative_ttl",
+			0,
+			0,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    ttl
+}`,
+			"Wrong argument count",
+			0,
+			0,
+		},
+	}
+
+	for i, test := range tests {
+		mcgw := MulticlusterGw{}
+		c := caddy.NewTestController("dns", test.input)
+		err := ParseStanza(c, &mcgw)
+		if test.expectedErrContent != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: Expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v", i, test.input, err)
+			continue
+		}
+		if mcgw.ttl != test.expectedTTL || mcgw.negativeTTL != test.expectedNegativeTTL {
+			t.Errorf("Test %d: Expected TTL %d and negative TTL %d, instead found %d and %d for input '%s'", i, test.expectedTTL, test.expectedNegativeTTL, mcgw.ttl, mcgw.negativeTTL, test.input)
+		}
+	}
+}
+
+// TestSetupSnapshotFile tests the parsing of the snapshot file, and of the interval it is written in.
+func TestSetupSnapshotFile(t *testing.T) {
+	tests := []struct {
+		input              string        // Corefile data as string
+		expectedErrContent string        // substring from the expected error. Empty for positive cases.
+		expectedFile       string        // expected snapshot file.
+		expectedInterval   time.Duration // expected interval of writing the snapshot file.
+	}{
+		{
+			`multicluster_gw svc.clusterset.local.`,
+			"",
+			"",
+			0,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    snapshot_file /var/lib/coredns/serviceimports.json
+}`,
+			"",
+			"/var/lib/coredns/serviceimports.json",
+			defaultSnapshotInterval,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    snapshot_file /var/lib/coredns/serviceimports.json 5m
+}`,
+			"",
+			"/var/lib/coredns/serviceimports.json",
+			5 * time.Minute,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    snapshot_file /var/lib/coredns/serviceimports.json 0s
+}`,
+			"invalid snapshot_file interval",
+			"",
+			0,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    snapshot_file
+}`,
+			"Wrong argument count",
+			"",
+			0,
+		},
+	}
+
+	for i, test := range tests {
+		mcgw := MulticlusterGw{}
+		c := caddy.NewTestController("dns", test.input)
+		err := ParseStanza(c, &mcgw)
+		if test.expectedErrContent != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: Expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v", i, test.input, err)
+			continue
+		}
+		if mcgw.snapshotFile != test.expectedFile || mcgw.snapshotInterval != test.expectedInterval {
+			t.Errorf("Test %d: Expected snapshot file '%s' every %v, instead found '%s' every %v for input '%s'", i, test.expectedFile, test.expectedInterval, mcgw.snapshotFile, mcgw.snapshotInterval, test.input)
+		}
+	}
+}
+
+// TestSetupMaxStale tests the parsing of max_stale, and of the mode of answering after it.
+func TestSetupMaxStale(t *testing.T) {
+	tests := []struct {
+		input              string        // Corefile data as string
+		expectedErrContent string        // substring from the expected error. Empty for positive cases.
+		expectedMaxStale   time.Duration // expected max_stale.
+		expectedMode       string        // expected mode of answering after max_stale.
+	}{
+		{
+			`multicluster_gw svc.clusterset.local.`,
+			"",
+			0,
+			staleServfail,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    max_stale 10m
+}`,
+			"",
+			10 * time.Minute,
+			staleServfail,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    max_stale 1h fallthrough
+}`,
+			"",
+			time.Hour,
+			staleFallthrough,
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    max_stale 1h forever
+}`,
+			"unknown max_stale mode",
+			0,
+			"",
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    max_stale -1h
+}`,
+			"invalid max_stale",
+			0,
+			"",
+		},
+		{
+			`multicluster_gw svc.clusterset.local. {
+    max_stale
+}`,
+			"Wrong argument count",
+			0,
+			"",
+		},
+	}
+
+	for i, test := range tests {
+		mcgw := MulticlusterGw{}
+		c := caddy.NewTestController("dns", test.input)
+		err := ParseStanza(c, &mcgw)
+		if test.expectedErrContent != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: Expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v", i, test.input, err)
+			continue
 		}
-		if !reflect.DeepEqual(Mcgw.gatewayIp6, test.expectedGatewayIp6) {
-			t.Errorf("Test %d: Expected kubernetes controller to be initialized with gateway Ip6 of '%v'. Instead found gateway Ip6 of '%v' for input '%s'", i, test.expectedGatewayIp6, Mcgw.gatewayIp6, test.input)
+		if mcgw.maxStale != test.expectedMaxStale || mcgw.staleMode != test.expectedMode {
+			t.Errorf("Test %d: Expected max_stale %v in mode %s, instead found %v in mode %s for input '%s'", i, test.expectedMaxStale, test.expectedMode, mcgw.maxStale, mcgw.staleMode, test.input)
 		}
 	}
 }
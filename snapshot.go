@@ -0,0 +1,175 @@
+package multicluster_gw
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// snapshotVersion is the version of the format of the snapshot file. A file of another version isn't loaded.
+const snapshotVersion = 1
+
+const defaultSnapshotInterval = 30 * time.Second
+
+// snapshotFile is the content of the snapshot file: what every cluster had on every ServiceImport.
+type snapshotFile struct {
+	Version int              `json:"version"`
+	Serial  uint32           `json:"serial"`
+	Imports []snapshotImport `json:"imports"`
+}
+
+type snapshotImport struct {
+	Cluster   string             `json:"cluster"`
+	Namespace string             `json:"namespace"`
+	Name      string             `json:"name"`
+	Info      *ServiceImportInfo `json:"info"`
+}
+
+// loadSnapshot adds the ServiceImports in the snapshot file to the store, marked as stale until their clusters
+// confirm them. ServiceImports of clusters that aren't configured anymore are ignored. A missing file isn't an
+// error, there is no snapshot before the first run. It returns the number of the ServiceImports it added.
+func loadSnapshot(path string, store *Store, clusters []Cluster) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var file snapshotFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return 0, fmt.Errorf("invalid snapshot file %s: %v", path, err)
+	}
+	if file.Version != snapshotVersion {
+		return 0, fmt.Errorf("snapshot file %s is of version %d, expected %d", path, file.Version, snapshotVersion)
+	}
+
+	configured := make(map[string]void, len(clusters))
+	for _, cluster := range clusters {
+		configured[cluster.Name] = member
+	}
+	records := make([]StoreRecord, 0, len(file.Imports))
+	for _, imported := range file.Imports {
+		if _, exists := configured[imported.Cluster]; !exists || imported.Info == nil {
+			continue
+		}
+		records = append(records, StoreRecord{
+			Cluster: imported.Cluster,
+			Name:    types.NamespacedName{Namespace: imported.Namespace, Name: imported.Name},
+			Info:    imported.Info,
+		})
+	}
+	return store.AddStale(records), nil
+}
+
+// writeSnapshot writes the records of the store to the snapshot file. The file is replaced at once,
+// so a crash in the middle of writing doesn't leave a partial file.
+func writeSnapshot(path string, serial uint32, records []StoreRecord) error {
+	file := snapshotFile{Version: snapshotVersion, Serial: serial, Imports: make([]snapshotImport, 0, len(records))}
+	for _, record := range records {
+		file.Imports = append(file.Imports, snapshotImport{
+			Cluster:   record.Cluster,
+			Namespace: record.Name.Namespace,
+			Name:      record.Name.Name,
+			Info:      record.Info,
+		})
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// snapshotWriter writes the store to the snapshot file every interval, if it changed since the last write,
+// and once more when it stops. Like the managers, it is hooked to the caddy lifecycle and runs only while
+// the server runs.
+type snapshotWriter struct {
+	store    *Store
+	path     string
+	interval time.Duration
+
+	written    bool   // if the store was written at all
+	lastSerial uint32 // the serial of the store that was written last
+
+	runMutex sync.Mutex
+	cancel   context.CancelFunc
+	running  sync.WaitGroup
+}
+
+func newSnapshotWriter(store *Store, path string, interval time.Duration) *snapshotWriter {
+	return &snapshotWriter{store: store, path: path, interval: interval}
+}
+
+// Start starts writing in the background, if it isn't running already.
+func (w *snapshotWriter) Start() error {
+	w.runMutex.Lock()
+	defer w.runMutex.Unlock()
+	if w.cancel != nil {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	w.running.Add(1)
+	go func() {
+		defer w.running.Done()
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				w.write()
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops writing, and writes the store a last time. Stopping when not running does nothing.
+func (w *snapshotWriter) Stop() error {
+	w.runMutex.Lock()
+	defer w.runMutex.Unlock()
+	if w.cancel == nil {
+		return nil
+	}
+	w.cancel()
+	w.running.Wait()
+	w.cancel = nil
+	w.write()
+	return nil
+}
+
+// write writes the store to the snapshot file, if it changed since the last write.
+// A failure is only logged, the next write tries again.
+func (w *snapshotWriter) write() {
+	serial, records := w.store.Records()
+	if w.written && serial == w.lastSerial {
+		return
+	}
+	if err := writeSnapshot(w.path, serial, records); err != nil {
+		log.Warningf("Failed to write the snapshot file %s: %v", w.path, err)
+		return
+	}
+	w.written, w.lastSerial = true, serial
+}
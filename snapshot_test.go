@@ -0,0 +1,81 @@
+package multicluster_gw
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+	mcsv1a1 "sigs.k8s.io/mcs-api/pkg/apis/v1alpha1"
+)
+
+// TestSnapshot checks that the ServiceImports written to the snapshot file are loaded as stale,
+// until their clusters confirm them or sync without them.
+func TestSnapshot(t *testing.T) {
+	assert := require.New(t)
+	path := filepath.Join(t.TempDir(), "serviceimports.json")
+	kafka := types.NamespacedName{Namespace: "test", Name: "kafka"}
+	web := types.NamespacedName{Namespace: "test", Name: "web"}
+	ttl := uint32(30)
+	kafkaInfo := &ServiceImportInfo{Type: mcsv1a1.ClusterSetIP, IPs: []net.IP{net.ParseIP("10.0.0.1")}, TTL: &ttl,
+		Ports: []mcsv1a1.ServicePort{{Name: "kafka", Protocol: "TCP", Port: 9092}}}
+
+	// there is no snapshot before the first run:
+	loaded, err := loadSnapshot(path, NewStore(), []Cluster{{Name: cluster1}})
+	assert.Nil(err)
+	assert.Zero(loaded)
+
+	store := NewStore()
+	store.Add(cluster1, kafka, kafkaInfo)
+	store.Add(cluster1, web, nil)
+	store.Add(cluster2, web, nil)
+	writer := newSnapshotWriter(store, path, defaultSnapshotInterval)
+	assert.Nil(writer.Start())
+	assert.Nil(writer.Stop()) // writes the last snapshot
+
+	// the ServiceImports of the clusters that aren't configured anymore are ignored:
+	restored := NewStore()
+	loaded, err = loadSnapshot(path, restored, []Cluster{{Name: cluster1}})
+	assert.Nil(err)
+	assert.Equal(2, loaded)
+	entry, exists := restored.Get(kafka)
+	assert.True(exists)
+	assert.True(entry.Stale)
+	assert.Equal(kafkaInfo.Ports, entry.Ports)
+	assert.Equal(ttl, *entry.TTL)
+	assert.True(containsIP(entry.IPs, net.ParseIP("10.0.0.1")))
+	entry, _ = restored.Get(web)
+	assert.Equal([]string{cluster1}, entry.Clusters)
+
+	// the ServiceImports the cluster failed to load stay stale:
+	assert.Zero(restored.DeleteStale(cluster1, map[types.NamespacedName]void{kafka: member, web: member}))
+	entry, _ = restored.Get(web)
+	assert.True(entry.Stale)
+
+	// the cluster confirms one of them, and syncs without the other:
+	restored.Add(cluster1, kafka, kafkaInfo)
+	entry, _ = restored.Get(kafka)
+	assert.False(entry.Stale)
+	assert.Equal(1, restored.DeleteStale(cluster1, nil))
+	assert.False(restored.Contains(web))
+	assert.True(restored.Contains(kafka))
+}
+
+// TestSnapshotInvalid checks that a snapshot file that can't be loaded leaves the store empty.
+func TestSnapshotInvalid(t *testing.T) {
+	assert := require.New(t)
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"garbage.json": "not json",
+		"future.json":  `{"version": 2, "imports": [{"cluster": "c1", "namespace": "test", "name": "kafka", "info": {}}]}`,
+	} {
+		path := filepath.Join(dir, name)
+		assert.Nil(os.WriteFile(path, []byte(content), 0o600))
+		store := NewStore()
+		_, err := loadSnapshot(path, store, []Cluster{{Name: cluster1}})
+		assert.NotNil(err, name)
+		assert.Zero(store.Len(), name)
+	}
+}
@@ -0,0 +1,223 @@
+package multicluster_gw
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	mcsv1a1 "sigs.k8s.io/mcs-api/pkg/apis/v1alpha1"
+)
+
+// The modes of answering when the answers were stale for longer than max_stale.
+const (
+	staleServe       = "serve"       // keep answering from the last known ServiceImports
+	staleServfail    = "servfail"    // answer SERVFAIL
+	staleFallthrough = "fallthrough" // pass the request to the next plugin
+)
+
+const (
+	staleProbeInterval = 5 * time.Second
+	staleProbeTimeout  = 5 * time.Second
+)
+
+// staleGauge is 1 for every cluster whose API server connection is lost, so the answers of its ServiceImports are stale.
+var staleGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "stale",
+	Help:      "Whether the connection to the API server of the cluster is lost, and its ServiceImports are stale (1) or not (0).",
+}, []string{"cluster"})
+
+// validStaleMode returns if the mode is one of the modes of answering after max_stale.
+func validStaleMode(mode string) bool {
+	switch mode {
+	case staleServe, staleServfail, staleFallthrough:
+		return true
+	}
+	return false
+}
+
+// staleTracker keeps which clusters lost the connection to their API servers, and since when.
+// While a connection is lost, the ServiceImports of the cluster are answered from the last known state.
+type staleTracker struct {
+	mutex sync.RWMutex
+	lost  map[string]time.Time // the clusters whose connection is lost, and since when
+	now   func() time.Time
+}
+
+func newStaleTracker() *staleTracker {
+	return &staleTracker{lost: make(map[string]time.Time), now: time.Now}
+}
+
+// lose marks the connection of the cluster as lost, if it isn't already.
+func (st *staleTracker) lose(cluster string, err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if _, lost := st.lost[cluster]; lost {
+		return
+	}
+	log.Warningf("Lost the connection to the API server of cluster '%s', answering from its last known ServiceImports: %v", cluster, err)
+	st.lost[cluster] = st.now()
+	staleGauge.WithLabelValues(cluster).Set(1)
+}
+
+// recover marks the connection of the cluster as working, if it was lost.
+func (st *staleTracker) recover(cluster string) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	since, lost := st.lost[cluster]
+	if !lost {
+		return
+	}
+	log.Infof("The connection to the API server of cluster '%s' is back, after %v", cluster, st.now().Sub(since).Round(time.Second))
+	delete(st.lost, cluster)
+	staleGauge.WithLabelValues(cluster).Set(0)
+}
+
+// pause clears the gauge of the lost connections when the managers that watch them stop, so a stopped plugin
+// instance doesn't report them. The lost connections are kept: if the managers start again (after a failed
+// reload), the last known ServiceImports are still as old as they were.
+func (st *staleTracker) pause() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for cluster := range st.lost {
+		staleGauge.WithLabelValues(cluster).Set(0)
+	}
+}
+
+// resume reports the lost connections again, when the managers that watch them start.
+func (st *staleTracker) resume() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for cluster := range st.lost {
+		staleGauge.WithLabelValues(cluster).Set(1)
+	}
+}
+
+// isLost returns if the connection of the cluster is lost.
+func (st *staleTracker) isLost(cluster string) bool {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	_, lost := st.lost[cluster]
+	return lost
+}
+
+// staleFor returns for how long the answers of the clusters are stale: since the earliest connection of them
+// that is still lost. It returns false if none of their connections is lost.
+func (st *staleTracker) staleFor(clusters []string) (time.Duration, bool) {
+	if st == nil {
+		return 0, false
+	}
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	var earliest time.Time
+	for _, cluster := range clusters {
+		since, lost := st.lost[cluster]
+		if lost && (earliest.IsZero() || since.Before(earliest)) {
+			earliest = since
+		}
+	}
+	if earliest.IsZero() {
+		return 0, false
+	}
+	return st.now().Sub(earliest), true
+}
+
+// isConnectionError returns if the error of a list or a watch means that the connection to the API server is lost:
+// the API server can't be reached, it times out, or it fails with a 5xx status. The other status errors (like
+// Unauthorized or Forbidden) are answers of a working API server, and a watch that was closed, or whose resource
+// version expired, is just restarted by the reflector.
+func isConnectionError(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return false
+	}
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		return status.Status().Code >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// watchConnection reports the failures of the list and the watch of the ServiceImports of the cluster to the
+// tracker, and while the connection is lost, probes the API server until it answers again.
+// It must be called before the manager starts.
+func watchConnection(mgr manager.Manager, cluster string, tracker *staleTracker) error {
+	informer, err := mgr.GetCache().GetInformer(context.Background(), &mcsv1a1.ServiceImport{})
+	if err != nil {
+		return err
+	}
+	sharedInformer, ok := informer.(toolscache.SharedIndexInformer)
+	if !ok {
+		return errors.New("the ServiceImport informer doesn't report its watch errors")
+	}
+	err = sharedInformer.SetWatchErrorHandler(func(r *toolscache.Reflector, err error) {
+		// keep the logs of the default handler:
+		toolscache.DefaultWatchErrorHandler(r, err)
+		if isConnectionError(err) {
+			tracker.lose(cluster, err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// the reflector doesn't report that it recovered, so the API server is probed directly:
+	reader := mgr.GetAPIReader()
+	return mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		ticker := time.NewTicker(staleProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+			if !tracker.isLost(cluster) {
+				continue
+			}
+			probeCtx, cancel := context.WithTimeout(ctx, staleProbeTimeout)
+			err := reader.List(probeCtx, &mcsv1a1.ServiceImportList{}, client.Limit(1))
+			cancel()
+			if err == nil {
+				tracker.recover(cluster)
+			}
+		}
+	}))
+}
+
+// staleness returns if the answer of the ServiceImport is stale: the connection to the API server of one of
+// its clusters is lost, or its info is from the snapshot file and its clusters haven't confirmed it yet.
+// expired is if a connection of its clusters is lost for longer than max_stale. The answers that aren't of a
+// ServiceImport (the apex, the reverse zones and the namespaces) are never stale.
+func (m MulticlusterGw) staleness(entry *ServiceImportEntry) (stale bool, expired bool) {
+	if entry == nil {
+		return false, false
+	}
+	staleFor, lost := m.stale.staleFor(entry.Clusters)
+	return lost || entry.Stale, lost && m.maxStale > 0 && staleFor > m.maxStale
+}
+
+// markStale attaches the Stale Answer extended DNS error (RFC 8914) to the response,
+// if the request supports EDNS.
+func markStale(message *dns.Msg, req *dns.Msg) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return
+	}
+	message.SetEdns0(opt.UDPSize(), opt.Do())
+	responseOpt := message.IsEdns0()
+	responseOpt.Option = append(responseOpt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
+}
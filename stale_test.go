@@ -0,0 +1,178 @@
+package multicluster_gw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// TestStaleTracker checks that the answers of clusters are stale since the earliest of their connections that is still lost.
+func TestStaleTracker(t *testing.T) {
+	assert := require.New(t)
+	now := time.Unix(1000, 0)
+	tracker := newStaleTracker()
+	tracker.now = func() time.Time { return now }
+	both := []string{cluster1, cluster2}
+
+	_, lost := tracker.staleFor(both)
+	assert.False(lost)
+
+	tracker.lose(cluster1, errors.New("connection refused"))
+	now = now.Add(time.Minute)
+	tracker.lose(cluster2, errors.New("connection refused"))
+	tracker.lose(cluster1, errors.New("still refused"))
+	now = now.Add(time.Minute)
+	staleFor, lost := tracker.staleFor(both)
+	assert.True(lost)
+	assert.Equal(2*time.Minute, staleFor)
+	staleFor, _ = tracker.staleFor([]string{cluster2})
+	assert.Equal(time.Minute, staleFor)
+	_, lost = tracker.staleFor([]string{"other"})
+	assert.False(lost)
+
+	tracker.recover(cluster1)
+	assert.False(tracker.isLost(cluster1))
+	staleFor, _ = tracker.staleFor(both)
+	assert.Equal(time.Minute, staleFor)
+	_, lost = tracker.staleFor([]string{cluster1})
+	assert.False(lost)
+
+	// the managers stopped and started again, their connections stay lost:
+	tracker.pause()
+	tracker.resume()
+	staleFor, lost = tracker.staleFor(both)
+	assert.True(lost)
+	assert.Equal(time.Minute, staleFor)
+}
+
+// TestIsConnectionError checks that only the failures to reach the API server lose the connection,
+// and not the answers of a working API server or the watches the reflector restarts by itself.
+func TestIsConnectionError(t *testing.T) {
+	serviceImports := schema.GroupResource{Group: "multicluster.x-k8s.io", Resource: "serviceimports"}
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	assert.True(t, isConnectionError(refused))
+	assert.True(t, isConnectionError(&url.Error{Op: "Get", URL: "https://10.0.0.1:6443", Err: refused}))
+	assert.True(t, isConnectionError(fmt.Errorf("failed to list: %w", context.DeadlineExceeded)))
+	assert.True(t, isConnectionError(apierrors.NewServiceUnavailable("unavailable")))
+	assert.True(t, isConnectionError(apierrors.NewInternalError(errors.New("etcd"))))
+	assert.True(t, isConnectionError(apierrors.NewTimeoutError("timeout", 1)))
+	assert.False(t, isConnectionError(apierrors.NewForbidden(serviceImports, "", errors.New("rbac"))))
+	assert.False(t, isConnectionError(apierrors.NewUnauthorized("expired token")))
+	assert.False(t, isConnectionError(io.EOF))
+	assert.False(t, isConnectionError(&url.Error{Op: "Get", URL: "https://10.0.0.1:6443", Err: io.EOF}))
+	assert.False(t, isConnectionError(apierrors.NewResourceExpired("too old resource version")))
+}
+
+// TestMultiClusterGwStale checks the answers while the connection to a cluster is lost, and after max_stale.
+// Only the answers of the ServiceImports of the cluster are stale.
+func TestMultiClusterGwStale(t *testing.T) {
+	assert := require.New(t)
+	mcgw := initMcgw()
+	mcgw.Store.Add(cluster1, types.NamespacedName{Namespace: "test", Name: "myservice"}, nil)
+	mcgw.Store.Add(cluster2, types.NamespacedName{Namespace: "test", Name: "web"}, nil)
+	now := time.Unix(1000, 0)
+	mcgw.stale.now = func() time.Time { return now }
+	ctx := context.TODO()
+
+	serveType := func(qname string, qtype uint16, edns bool) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(qname, qtype)
+		if edns {
+			r.SetEdns0(4096, false)
+		}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := mcgw.ServeDNS(ctx, rec, r)
+		assert.Nil(err)
+		return rec.Msg
+	}
+	serve := func(qname string, edns bool) *dns.Msg {
+		return serveType(qname, dns.TypeA, edns)
+	}
+	isStale := func(msg *dns.Msg) bool {
+		opt := msg.IsEdns0()
+		if opt == nil {
+			return false
+		}
+		for _, option := range opt.Option {
+			if ede, ok := option.(*dns.EDNS0_EDE); ok && ede.InfoCode == dns.ExtendedErrorCodeStaleAnswer {
+				return true
+			}
+		}
+		return false
+	}
+
+	// connected:
+	msg := serve("myservice.test.svc.clusterset.local.", true)
+	assert.Len(msg.Answer, 1)
+	assert.False(isStale(msg))
+
+	// the answers of the cluster are stale, marked only if the request has EDNS:
+	mcgw.stale.lose(cluster1, errors.New("connection refused"))
+	msg = serve("myservice.test.svc.clusterset.local.", true)
+	assert.Len(msg.Answer, 1)
+	assert.True(isStale(msg))
+	msg = serve("myservice.test.svc.clusterset.local.", false)
+	assert.Len(msg.Answer, 1)
+	assert.Nil(msg.IsEdns0())
+	// the other cluster, the names that don't exist and the apex aren't:
+	assert.False(isStale(serve("web.test.svc.clusterset.local.", true)))
+	msg = serve("other.test.svc.clusterset.local.", true)
+	assert.Equal(dns.RcodeNameError, msg.Rcode)
+	assert.False(isStale(msg))
+	assert.False(isStale(serveType("svc.clusterset.local.", dns.TypeSOA, true)))
+
+	// after max_stale, by the mode, only for the ServiceImports of the cluster:
+	mcgw.maxStale = time.Minute
+	now = now.Add(2 * time.Minute)
+	mcgw.staleMode = staleServfail
+	assert.Equal(dns.RcodeServerFailure, serve("myservice.test.svc.clusterset.local.", true).Rcode)
+	msg = serve("web.test.svc.clusterset.local.", true)
+	assert.Len(msg.Answer, 1)
+	assert.False(isStale(msg))
+	msg = serveType("svc.clusterset.local.", dns.TypeSOA, true)
+	assert.Equal(dns.RcodeSuccess, msg.Rcode)
+	assert.Len(msg.Answer, 1)
+	mcgw.staleMode = staleServe
+	msg = serve("myservice.test.svc.clusterset.local.", true)
+	assert.Len(msg.Answer, 1)
+	assert.True(isStale(msg))
+	mcgw.staleMode = staleFallthrough
+	r := new(dns.Msg)
+	r.SetQuestion("myservice.test.svc.clusterset.local.", dns.TypeA)
+	rcode, _ := mcgw.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), r)
+	assert.Equal(dns.RcodeServerFailure, rcode) // returned by the next plugin
+	r.SetQuestion("web.test.svc.clusterset.local.", dns.TypeA)
+	rcode, _ = mcgw.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), r)
+	assert.Equal(dns.RcodeSuccess, rcode)
+
+	// back to normal when the connection recovers:
+	mcgw.stale.recover(cluster1)
+	msg = serve("myservice.test.svc.clusterset.local.", true)
+	assert.Len(msg.Answer, 1)
+	assert.False(isStale(msg))
+
+	// the ServiceImports of a snapshot are stale until they are confirmed, the others aren't:
+	kafka := types.NamespacedName{Namespace: "test", Name: "kafka"}
+	mcgw.Store.AddStale([]StoreRecord{{Cluster: cluster1, Name: kafka, Info: &ServiceImportInfo{}}})
+	msg = serve("kafka.test.svc.clusterset.local.", true)
+	assert.Len(msg.Answer, 1)
+	assert.True(isStale(msg))
+	assert.False(isStale(serve("myservice.test.svc.clusterset.local.", true)))
+	mcgw.Store.Add(cluster1, kafka, nil)
+	assert.False(isStale(serve("kafka.test.svc.clusterset.local.", true)))
+}
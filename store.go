@@ -0,0 +1,694 @@
+package multicluster_gw
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	mcsv1a1 "sigs.k8s.io/mcs-api/pkg/apis/v1alpha1"
+)
+
+type void struct{}
+
+var member void
+
+// ServiceImportInfo is what we keep from a ServiceImport, to answer the queries about it.
+type ServiceImportInfo struct {
+	Type       mcsv1a1.ServiceImportType
+	Ports      []mcsv1a1.ServicePort
+	IPs        []net.IP   // the ClusterSetIPs
+	AnswerMode string     // answerGateway or answerClusterSetIP, if the ServiceImport overrides the mode of its zone
+	Endpoints  []Endpoint // the endpoints of a headless ServiceImport, from all the clusters
+	GatewayIPs []net.IP   // the gateway addresses of the ServiceImport, if it overrides the gateway of the plugin
+	GatewayRef string     // the Gateway (NAMESPACE/NAME) that GatewayIPs come from, if the ServiceImport refers to one
+	TTL        *uint32    // the TTL of the records of the ServiceImport, if it overrides the TTL of the plugin
+}
+
+// Endpoint is an endpoint of a headless ServiceImport, in one of the clusters of the cluster set.
+type Endpoint struct {
+	ClusterID string
+	Hostname  string // empty if the endpoint has no hostname
+	IPs       []net.IP
+}
+
+// ServiceImportEntry is a ServiceImport in the store, with its info merged from all the clusters that have it.
+type ServiceImportEntry struct {
+	Name     types.NamespacedName
+	Clusters []string // the clusters that have the ServiceImport, sorted
+	Stale    bool     // some of the info is from a snapshot, and its clusters haven't confirmed it yet
+	ServiceImportInfo
+}
+
+// StoreSnapshot is a consistent view of the store: its ServiceImports (sorted by namespace and name)
+// and the serial of the store when they were taken.
+type StoreSnapshot struct {
+	Serial  uint32
+	Entries []ServiceImportEntry
+}
+
+// StoreEventType is the kind of a change of a ServiceImport in the store.
+type StoreEventType int
+
+const (
+	StoreAdded   StoreEventType = iota // the first cluster added the ServiceImport
+	StoreUpdated                       // a cluster added, changed or removed the ServiceImport, and it is still in the store
+	StoreDeleted                       // the last cluster removed the ServiceImport
+)
+
+func (t StoreEventType) String() string {
+	switch t {
+	case StoreAdded:
+		return "added"
+	case StoreUpdated:
+		return "updated"
+	case StoreDeleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// StoreEvent is a change of a ServiceImport in the store.
+type StoreEvent struct {
+	Type   StoreEventType
+	Entry  ServiceImportEntry // the ServiceImport after the change, or before it if it was deleted
+	Serial uint32             // the serial of the store after the change
+}
+
+// storeSubscriber is a subscription to the changes of the store.
+type storeSubscriber struct {
+	notify func(StoreEvent)
+}
+
+// storeShards is the number of the shards of the store. A change copies only the shard of the ServiceImport.
+const storeShards = 256
+
+// Store keeps the ServiceImports of all the clusters, by their namespaced name.
+// Every ServiceImport remembers the clusters it was seen in, and what each cluster told us about it,
+// so it stays in the store as long as at least one cluster still has the ServiceImport.
+//
+// The queries read the store much more than the reconcilers change it, so the reads take no locks:
+// the content of the store is an immutable root, which every change replaces with a copy (copy on write).
+// The root is sharded by the names of the ServiceImports, so a change copies only one shard, and the
+// info of every ServiceImport is merged from its clusters when it changes, not when it is read.
+// The entries the store returns are shared with it and with the other readers, they must not be modified in place.
+type Store struct {
+	root  atomic.Value // *storeRoot
+	mutex sync.Mutex   // serializes the changes, and the notifications of the subscribers
+
+	subscribers []*storeSubscriber // guarded by the mutex
+}
+
+// storeRoot is the content of the store at one serial. It is never modified once it is published.
+// A change copies only what it changes, so its cost is by the size of the shards and not of the store:
+//   - the map of the shard of the ServiceImport, about 1/storeShards of the ServiceImports;
+//   - when a ServiceImport is added or removed, the map of the shard of its namespace, and the sorted
+//     names of its namespace, so adding to or removing from a namespace of n ServiceImports costs O(n);
+//   - when its addresses change, the maps of the shards of the addresses, and the names that have each one.
+//
+// The names of a namespace are copied whole so List reads them in order without sorting,
+// as ServiceImports come and go far less often than they are read.
+type storeRoot struct {
+	serial     uint32 // incremented on every change of the store, used as the serial of the zones' SOA
+	size       int
+	imports    [storeShards]map[types.NamespacedName]*storeItem // by the shard of the name
+	namespaces [storeShards]map[string][]string                 // the sorted names of the ServiceImports of a namespace, by the shard of the namespace
+	addresses  [storeShards]map[string][]types.NamespacedName   // the sorted ServiceImports that have an address, by the shard of the address
+}
+
+// storeItem is a ServiceImport in the store.
+type storeItem struct {
+	clusters map[string]*ServiceImportInfo // cluster -> the info the cluster has on it
+	stale    map[string]void               // the clusters whose info is from a snapshot, and they haven't confirmed it yet
+	entry    ServiceImportEntry            // merged from all the clusters
+}
+
+func NewStore() *Store {
+	root := &storeRoot{
+		// start from the current time, so the serial doesn't go backwards when we restart
+		serial: uint32(time.Now().Unix()),
+	}
+	for i := range root.imports {
+		root.imports[i] = make(map[types.NamespacedName]*storeItem)
+		root.namespaces[i] = make(map[string][]string)
+		root.addresses[i] = make(map[string][]types.NamespacedName)
+	}
+	s := &Store{}
+	s.root.Store(root)
+	return s
+}
+
+// load returns the current root of the store.
+func (s *Store) load() *storeRoot {
+	return s.root.Load().(*storeRoot)
+}
+
+// Add adds the ServiceImport to the store (or updates it), as seen in the cluster. info may be nil.
+// If the cluster had the ServiceImport from a snapshot, it is confirmed.
+func (s *Store) Add(cluster string, name types.NamespacedName, info *ServiceImportInfo) {
+	if info == nil {
+		info = &ServiceImportInfo{}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.setLocked(cluster, name, info, false)
+}
+
+// Delete removes the ServiceImport of the cluster from the store. It returns false if the cluster didn't have it.
+func (s *Store) Delete(cluster string, name types.NamespacedName) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.setLocked(cluster, name, nil, false)
+}
+
+// StoreRecord is what one cluster has on a ServiceImport.
+type StoreRecord struct {
+	Cluster string
+	Name    types.NamespacedName
+	Info    *ServiceImportInfo
+}
+
+// Records returns what every cluster has on every ServiceImport, with the serial of the store they are of.
+// The records are sorted by the namespace, the name and the cluster.
+func (s *Store) Records() (uint32, []StoreRecord) {
+	root := s.load()
+	var records []StoreRecord
+	for _, entry := range root.list("") {
+		item := root.imports[shardOf(entry.Name)][entry.Name]
+		for _, cluster := range entry.Clusters {
+			records = append(records, StoreRecord{Cluster: cluster, Name: entry.Name, Info: item.clusters[cluster]})
+		}
+	}
+	return root.serial, records
+}
+
+// AddStale adds the records that the store doesn't have yet, marked as stale: they are from a snapshot,
+// and the clusters haven't confirmed them. It returns the number of the records it added.
+func (s *Store) AddStale(records []StoreRecord) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	added := 0
+	for _, record := range records {
+		if _, exists := s.load().imports[shardOf(record.Name)][record.Name].clusterMap()[record.Cluster]; exists {
+			// the cluster got to it already
+			continue
+		}
+		if s.setLocked(record.Cluster, record.Name, record.Info, true) {
+			added++
+		}
+	}
+	return added
+}
+
+// DeleteStale removes the stale ServiceImports of the cluster, the ones it didn't confirm, but the ones to keep.
+// It returns the number of the ServiceImports it removed.
+func (s *Store) DeleteStale(cluster string, keep map[types.NamespacedName]void) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var stale []types.NamespacedName
+	for _, shard := range s.load().imports {
+		for name, item := range shard {
+			if _, kept := keep[name]; !kept && item.isStale(cluster) {
+				stale = append(stale, name)
+			}
+		}
+	}
+	for _, name := range stale {
+		s.setLocked(cluster, name, nil, false)
+	}
+	return len(stale)
+}
+
+// setLocked sets the info the cluster has on the ServiceImport, or removes it if info is nil, and publishes
+// the change to the readers and the subscribers. It returns false if nothing changed. The mutex must be locked.
+func (s *Store) setLocked(cluster string, name types.NamespacedName, info *ServiceImportInfo, stale bool) bool {
+	old := s.load()
+	shard := shardOf(name)
+	item := old.imports[shard][name]
+	current, exists := item.clusterMap()[cluster]
+	if info == nil && !exists {
+		return false
+	}
+	if info != nil && exists && item.isStale(cluster) == stale && reflect.DeepEqual(current, info) {
+		// nothing changed (a resync)
+		return false
+	}
+
+	next := item.with(name, cluster, info, stale)
+	root := old.next()
+	root.imports[shard] = copyImports(old.imports[shard])
+	event := StoreEvent{Type: StoreUpdated, Serial: root.serial}
+	switch {
+	case item == nil:
+		root.size++
+		root.setNamespace(name, true)
+		event.Type = StoreAdded
+	case next == nil:
+		root.size--
+		root.setNamespace(name, false)
+		event.Type = StoreDeleted
+	}
+	root.updateAddresses(name, item.addresses(), next.addresses())
+	if next == nil {
+		delete(root.imports[shard], name)
+		event.Entry = item.entry
+	} else {
+		root.imports[shard][name] = next
+		event.Entry = next.entry
+	}
+	s.root.Store(root)
+	s.notifyLocked(event)
+	return true
+}
+
+// Subscribe calls notify with every change of the store, in the order of the changes, until the returned
+// cancel function is called. If replay is true, notify is first called with an added event of every
+// ServiceImport in the store, so the subscriber starts from a consistent snapshot without missing a change.
+// notify is called while the store is locked for changes: it must return quickly, and it must not change
+// the store or cancel a subscription (it may read the store).
+func (s *Store) Subscribe(notify func(StoreEvent), replay bool) (cancel func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if replay {
+		root := s.load()
+		for _, entry := range root.list("") {
+			notify(StoreEvent{Type: StoreAdded, Entry: entry, Serial: root.serial})
+		}
+	}
+
+	subscriber := &storeSubscriber{notify: notify}
+	s.subscribers = append(s.subscribers, subscriber)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			subscribers := make([]*storeSubscriber, 0, len(s.subscribers))
+			for _, other := range s.subscribers {
+				if other != subscriber {
+					subscribers = append(subscribers, other)
+				}
+			}
+			s.subscribers = subscribers
+		})
+	}
+}
+
+// notifyLocked notifies the subscribers of the change. The mutex must be locked.
+func (s *Store) notifyLocked(event StoreEvent) {
+	for _, subscriber := range s.subscribers {
+		subscriber.notify(event)
+	}
+}
+
+// Contains returns if any of the clusters has the ServiceImport.
+func (s *Store) Contains(name types.NamespacedName) bool {
+	_, exists := s.load().imports[shardOf(name)][name]
+	return exists
+}
+
+// Get returns the ServiceImport, merged from all the clusters that have it.
+func (s *Store) Get(name types.NamespacedName) (ServiceImportEntry, bool) {
+	item, exists := s.load().imports[shardOf(name)][name]
+	if !exists {
+		return ServiceImportEntry{}, false
+	}
+	return item.entry, true
+}
+
+// HasNamespace returns if any ServiceImport exists in the namespace.
+func (s *Store) HasNamespace(namespace string) bool {
+	_, exists := s.load().namespaces[keyShardOf(namespace)][namespace]
+	return exists
+}
+
+// List returns the ServiceImports of the namespace (of all the namespaces if it is empty), sorted by name.
+func (s *Store) List(namespace string) []ServiceImportEntry {
+	return s.load().list(namespace)
+}
+
+// Snapshot returns all the ServiceImports, with the serial of the store they are of.
+func (s *Store) Snapshot() StoreSnapshot {
+	root := s.load()
+	return StoreSnapshot{Serial: root.serial, Entries: root.list("")}
+}
+
+// Serial returns the serial of the store, which changes whenever the store changes.
+func (s *Store) Serial() uint32 {
+	return s.load().serial
+}
+
+// ByAddress returns the ServiceImports that have the address as a ClusterSetIP, as an address of an endpoint,
+// or as an address of their own gateway, sorted by namespace and name.
+func (s *Store) ByAddress(ip net.IP) []ServiceImportEntry {
+	root := s.load()
+	key := ip.String()
+	names := root.addresses[keyShardOf(key)][key]
+	entries := make([]ServiceImportEntry, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, root.imports[shardOf(name)][name].entry)
+	}
+	return entries
+}
+
+// Len returns the number of the ServiceImports in the store.
+func (s *Store) Len() int {
+	return s.load().size
+}
+
+// next returns a copy of the root for the next change, sharing all the shards with it.
+func (root *storeRoot) next() *storeRoot {
+	next := *root
+	next.serial++
+	return &next
+}
+
+// updateAddresses moves the ServiceImport from the addresses it doesn't have anymore to the ones it has now.
+func (root *storeRoot) updateAddresses(name types.NamespacedName, old []string, current []string) {
+	for _, address := range old {
+		if !containsString(current, address) {
+			root.setAddress(address, name, false)
+		}
+	}
+	for _, address := range current {
+		if !containsString(old, address) {
+			root.setAddress(address, name, true)
+		}
+	}
+}
+
+// setAddress adds the ServiceImport to the ones that have the address, or removes it, copying the shard of the address.
+func (root *storeRoot) setAddress(address string, name types.NamespacedName, exists bool) {
+	shard := keyShardOf(address)
+	addresses := make(map[string][]types.NamespacedName, len(root.addresses[shard])+1)
+	for other, names := range root.addresses[shard] {
+		addresses[other] = names
+	}
+
+	old := addresses[address]
+	i := sort.Search(len(old), func(i int) bool { return !lessName(old[i], name) })
+	var names []types.NamespacedName
+	if exists {
+		names = make([]types.NamespacedName, 0, len(old)+1)
+		names = append(append(append(names, old[:i]...), name), old[i:]...)
+	} else {
+		names = make([]types.NamespacedName, 0, len(old)-1)
+		names = append(append(names, old[:i]...), old[i+1:]...)
+	}
+	if len(names) > 0 {
+		addresses[address] = names
+	} else {
+		delete(addresses, address)
+	}
+	root.addresses[shard] = addresses
+}
+
+// setNamespace adds the name of the ServiceImport to its namespace, or removes it, copying the shard of the namespace.
+// The names of a namespace are copied only when a ServiceImport is added to it or removed from it, not when one changes.
+func (root *storeRoot) setNamespace(name types.NamespacedName, exists bool) {
+	shard := keyShardOf(name.Namespace)
+	namespaces := make(map[string][]string, len(root.namespaces[shard])+1)
+	for namespace, names := range root.namespaces[shard] {
+		namespaces[namespace] = names
+	}
+
+	old := namespaces[name.Namespace]
+	i := sort.SearchStrings(old, name.Name)
+	var names []string
+	if exists {
+		names = make([]string, 0, len(old)+1)
+		names = append(append(append(names, old[:i]...), name.Name), old[i:]...)
+	} else {
+		names = make([]string, 0, len(old)-1)
+		names = append(append(names, old[:i]...), old[i+1:]...)
+	}
+	if len(names) > 0 {
+		namespaces[name.Namespace] = names
+	} else {
+		delete(namespaces, name.Namespace)
+	}
+	root.namespaces[shard] = namespaces
+}
+
+func (root *storeRoot) list(namespace string) []ServiceImportEntry {
+	if namespace != "" {
+		names := root.namespaces[keyShardOf(namespace)][namespace]
+		entries := make([]ServiceImportEntry, 0, len(names))
+		for _, name := range names {
+			name := types.NamespacedName{Namespace: namespace, Name: name}
+			entries = append(entries, root.imports[shardOf(name)][name].entry)
+		}
+		return entries
+	}
+
+	entries := make([]ServiceImportEntry, 0, root.size)
+	for _, shard := range root.imports {
+		for _, item := range shard {
+			entries = append(entries, item.entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return lessName(entries[i].Name, entries[j].Name) })
+	return entries
+}
+
+// with returns a copy of the item (of a new one if it is nil), in which the cluster has the info, or doesn't have
+// the ServiceImport if info is nil. It returns nil if no cluster has the ServiceImport anymore.
+func (item *storeItem) with(name types.NamespacedName, cluster string, info *ServiceImportInfo, stale bool) *storeItem {
+	next := &storeItem{clusters: make(map[string]*ServiceImportInfo), stale: make(map[string]void)}
+	if item != nil {
+		for c, i := range item.clusters {
+			if c != cluster {
+				next.clusters[c] = i
+			}
+		}
+		for c := range item.stale {
+			if c != cluster {
+				next.stale[c] = member
+			}
+		}
+	}
+	if info != nil {
+		next.clusters[cluster] = info
+		if stale {
+			next.stale[cluster] = member
+		}
+	}
+	if len(next.clusters) == 0 {
+		return nil
+	}
+	next.entry = newEntry(name, next.clusters)
+	next.entry.Stale = len(next.stale) > 0
+	return next
+}
+
+// isStale returns if the info of the cluster is from a snapshot, and the cluster hasn't confirmed it yet.
+func (item *storeItem) isStale(cluster string) bool {
+	if item == nil {
+		return false
+	}
+	_, stale := item.stale[cluster]
+	return stale
+}
+
+// addresses returns the addresses of the ServiceImport of the item, that it can be looked up by: its ClusterSetIPs,
+// the addresses of its endpoints and of its own gateway. There are none if the item is nil.
+func (item *storeItem) addresses() []string {
+	if item == nil {
+		return nil
+	}
+	var addresses []string
+	add := func(ips []net.IP) {
+		for _, ip := range ips {
+			if address := ip.String(); !containsString(addresses, address) {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+	add(item.entry.IPs)
+	add(item.entry.GatewayIPs)
+	for _, endpoint := range item.entry.Endpoints {
+		add(endpoint.IPs)
+	}
+	return addresses
+}
+
+// clusterMap returns the clusters of the item, nil if there is no item.
+func (item *storeItem) clusterMap() map[string]*ServiceImportInfo {
+	if item == nil {
+		return nil
+	}
+	return item.clusters
+}
+
+// lessName orders the ServiceImports by namespace and name.
+func lessName(name types.NamespacedName, other types.NamespacedName) bool {
+	if name.Namespace != other.Namespace {
+		return name.Namespace < other.Namespace
+	}
+	return name.Name < other.Name
+}
+
+// containsString returns if the strings contain the string.
+func containsString(strs []string, str string) bool {
+	for _, other := range strs {
+		if other == str {
+			return true
+		}
+	}
+	return false
+}
+
+// copyImports returns a copy of a shard of the ServiceImports, to change.
+func copyImports(shard map[types.NamespacedName]*storeItem) map[types.NamespacedName]*storeItem {
+	copied := make(map[types.NamespacedName]*storeItem, len(shard)+1)
+	for name, item := range shard {
+		copied[name] = item
+	}
+	return copied
+}
+
+// The parameters of the FNV-1a hash, that the shards are by.
+const (
+	fnvOffset = 2166136261
+	fnvPrime  = 16777619
+)
+
+// shardOf returns the shard of the ServiceImport, by the hash of its namespace and name.
+func shardOf(name types.NamespacedName) int {
+	return int(hashString(hashString(fnvOffset, name.Namespace), name.Name) % storeShards)
+}
+
+// keyShardOf returns the shard of a key of an index: a namespace or an address.
+func keyShardOf(key string) int {
+	return int(hashString(fnvOffset, key) % storeShards)
+}
+
+// hashString adds the string to the FNV-1a hash.
+func hashString(hash uint32, s string) uint32 {
+	for i := 0; i < len(s); i++ {
+		hash ^= uint32(s[i])
+		hash *= fnvPrime
+	}
+	return hash
+}
+
+// newEntry returns the entry of the ServiceImport, with its info merged from all the clusters that have it.
+// The clusters are merged in the order of their names, so the first cluster that has a value is the same every time.
+func newEntry(name types.NamespacedName, clusters map[string]*ServiceImportInfo) ServiceImportEntry {
+	entry := ServiceImportEntry{Name: name, Clusters: make([]string, 0, len(clusters))}
+	for cluster := range clusters {
+		entry.Clusters = append(entry.Clusters, cluster)
+	}
+	sort.Strings(entry.Clusters)
+	for _, cluster := range entry.Clusters {
+		entry.merge(clusters[cluster])
+	}
+	return entry
+}
+
+// merge adds to info the ports and ips of other, that it doesn't have yet.
+// The type, answer mode and gateway ref are taken from the first cluster that has them (by the cluster names).
+func (info *ServiceImportInfo) merge(other *ServiceImportInfo) {
+	if info.Type == "" {
+		info.Type = other.Type
+	}
+	if info.AnswerMode == "" {
+		info.AnswerMode = other.AnswerMode
+	}
+	if info.GatewayRef == "" {
+		info.GatewayRef = other.GatewayRef
+	}
+	info.GatewayIPs = mergeIPs(info.GatewayIPs, other.GatewayIPs)
+	if other.TTL != nil && (info.TTL == nil || *other.TTL < *info.TTL) {
+		// the shortest TTL of the clusters, as the ServiceImport changes the fastest there
+		ttl := *other.TTL
+		info.TTL = &ttl
+	}
+	for _, ip := range other.IPs {
+		if !containsIP(info.IPs, ip) {
+			info.IPs = append(info.IPs, ip)
+		}
+	}
+	for _, endpoint := range other.Endpoints {
+		if !info.containsEndpoint(endpoint) {
+			info.Endpoints = append(info.Endpoints, endpoint)
+		}
+	}
+	for _, port := range other.Ports {
+		if _, found := info.findPort(port.Name, portProtocol(port)); !found {
+			info.Ports = append(info.Ports, port)
+		}
+	}
+}
+
+// containsEndpoint returns if info already has the endpoint, as seen from another cluster.
+func (info *ServiceImportInfo) containsEndpoint(endpoint Endpoint) bool {
+	for _, other := range info.Endpoints {
+		if other.ClusterID == endpoint.ClusterID && other.Hostname == endpoint.Hostname && sameIPs(other.IPs, endpoint.IPs) {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointsOf returns the endpoints of the cluster (case insensitive), or only the one with
+// the hostname if a hostname is given.
+func (info *ServiceImportInfo) endpointsOf(clusterID string, hostname string) []Endpoint {
+	var endpoints []Endpoint
+	for _, endpoint := range info.Endpoints {
+		if !strings.EqualFold(endpoint.ClusterID, clusterID) {
+			continue
+		}
+		if hostname != "" && !strings.EqualFold(endpoint.Hostname, hostname) {
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
+}
+
+// findPort returns the port with the given name and protocol (case insensitive).
+func (info *ServiceImportInfo) findPort(name string, protocol string) (mcsv1a1.ServicePort, bool) {
+	for _, port := range info.Ports {
+		if strings.EqualFold(port.Name, name) && strings.EqualFold(portProtocol(port), protocol) {
+			return port, true
+		}
+	}
+	return mcsv1a1.ServicePort{}, false
+}
+
+// portProtocol returns the protocol of the port, which is TCP if it wasn't set.
+func portProtocol(port mcsv1a1.ServicePort) string {
+	if port.Protocol == "" {
+		return string(corev1.ProtocolTCP)
+	}
+	return string(port.Protocol)
+}
+
+// containsIP returns if ip is one of ips.
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, other := range ips {
+		if other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameIPs returns if both lists have the same ips, in the same order.
+func sameIPs(ips []net.IP, others []net.IP) bool {
+	if len(ips) != len(others) {
+		return false
+	}
+	for i := range ips {
+		if !ips[i].Equal(others[i]) {
+			return false
+		}
+	}
+	return true
+}
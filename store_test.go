@@ -0,0 +1,347 @@
+package multicluster_gw
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+	mcsv1a1 "sigs.k8s.io/mcs-api/pkg/apis/v1alpha1"
+)
+
+// TestStore checks that the ServiceImports are merged from their clusters, and indexed by their namespace.
+func TestStore(t *testing.T) {
+	assert := require.New(t)
+	store := NewStore()
+	kafka := types.NamespacedName{Namespace: "test", Name: "kafka"}
+	web := types.NamespacedName{Namespace: "test", Name: "web"}
+	db := types.NamespacedName{Namespace: "other", Name: "db"}
+	ttl30, ttl10 := uint32(30), uint32(10)
+
+	store.Add(cluster2, kafka, &ServiceImportInfo{Type: mcsv1a1.ClusterSetIP, AnswerMode: answerGateway,
+		IPs: []net.IP{net.IPv4(10, 0, 0, 2).To4()}, TTL: &ttl10})
+	store.Add(cluster1, kafka, &ServiceImportInfo{Type: mcsv1a1.ClusterSetIP, AnswerMode: answerClusterSetIP,
+		IPs: []net.IP{net.IPv4(10, 0, 0, 1).To4()}, TTL: &ttl30})
+	store.Add(cluster1, web, nil)
+	store.Add(cluster1, db, nil)
+	assert.Equal(3, store.Len())
+
+	entry, exists := store.Get(kafka)
+	assert.True(exists)
+	assert.Equal(kafka, entry.Name)
+	assert.Equal([]string{cluster1, cluster2}, entry.Clusters)
+	// the answer mode is of the first cluster by name, the TTL is the shortest:
+	assert.Equal(answerClusterSetIP, entry.AnswerMode)
+	assert.Equal(ttl10, *entry.TTL)
+	assert.Equal([]net.IP{net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4()}, entry.IPs)
+
+	assert.True(store.HasNamespace("test"))
+	assert.False(store.HasNamespace("missing"))
+	names := func(entries []ServiceImportEntry) []types.NamespacedName {
+		var names []types.NamespacedName
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		return names
+	}
+	assert.Equal([]types.NamespacedName{kafka, web}, names(store.List("test")))
+	assert.Equal([]types.NamespacedName{db, kafka, web}, names(store.List("")))
+	assert.Empty(store.List("missing"))
+
+	// a ServiceImport stays as long as one of its clusters has it, and its namespace as long as it has one:
+	assert.False(store.Delete(cluster2, web))
+	// indexed by the addresses:
+	assert.Equal([]types.NamespacedName{kafka}, names(store.ByAddress(net.ParseIP("10.0.0.2"))))
+	assert.Empty(store.ByAddress(net.ParseIP("10.0.0.3")))
+
+	assert.True(store.Delete(cluster2, kafka))
+	assert.Empty(store.ByAddress(net.ParseIP("10.0.0.2")))
+	assert.Equal([]types.NamespacedName{kafka}, names(store.ByAddress(net.ParseIP("10.0.0.1"))))
+	assert.True(store.Contains(kafka))
+	assert.True(store.Delete(cluster1, kafka))
+	assert.False(store.Contains(kafka))
+	assert.True(store.HasNamespace("test"))
+	assert.True(store.Delete(cluster1, web))
+	assert.False(store.HasNamespace("test"))
+	assert.False(store.Delete(cluster1, web))
+}
+
+// TestStoreSnapshot checks that a snapshot holds the entries of the serial it was taken at.
+func TestStoreSnapshot(t *testing.T) {
+	assert := require.New(t)
+	store := NewStore()
+	name := types.NamespacedName{Namespace: "test", Name: "myservice"}
+
+	serial := store.Serial()
+	store.Add(cluster1, name, &ServiceImportInfo{IPs: []net.IP{net.IPv4(10, 0, 0, 1).To4()}})
+	snapshot := store.Snapshot()
+	assert.Equal(serial+1, snapshot.Serial)
+	assert.Len(snapshot.Entries, 1)
+
+	// a resync changes nothing:
+	store.Add(cluster1, name, &ServiceImportInfo{IPs: []net.IP{net.IPv4(10, 0, 0, 1).To4()}})
+	assert.Equal(snapshot.Serial, store.Serial())
+
+	// later changes don't change the snapshot:
+	store.Add(cluster1, name, &ServiceImportInfo{IPs: []net.IP{net.IPv4(10, 0, 0, 2).To4()}})
+	store.Delete(cluster1, name)
+	assert.Equal(serial+3, store.Serial())
+	assert.Equal([]net.IP{net.IPv4(10, 0, 0, 1).To4()}, snapshot.Entries[0].IPs)
+}
+
+// TestStoreSubscribe checks that a subscriber gets the changes of the store in order, after the replay of its content.
+func TestStoreSubscribe(t *testing.T) {
+	assert := require.New(t)
+	store := NewStore()
+	kafka := types.NamespacedName{Namespace: "test", Name: "kafka"}
+	web := types.NamespacedName{Namespace: "test", Name: "web"}
+	store.Add(cluster1, kafka, nil)
+
+	type change struct {
+		Type     StoreEventType
+		Name     types.NamespacedName
+		Clusters []string
+	}
+	var changes []change
+	lastSerial := uint32(0)
+	cancel := store.Subscribe(func(event StoreEvent) {
+		assert.GreaterOrEqual(event.Serial, lastSerial)
+		lastSerial = event.Serial
+		changes = append(changes, change{event.Type, event.Entry.Name, event.Entry.Clusters})
+	}, true)
+
+	store.Add(cluster2, kafka, nil)
+	store.Add(cluster2, kafka, nil) // a resync isn't a change
+	store.Add(cluster1, web, nil)
+	store.Delete(cluster1, kafka)
+	store.Delete(cluster2, kafka)
+	assert.Equal(store.Serial(), lastSerial)
+	assert.Equal([]change{
+		{StoreAdded, kafka, []string{cluster1}}, // the replay
+		{StoreUpdated, kafka, []string{cluster1, cluster2}},
+		{StoreAdded, web, []string{cluster1}},
+		{StoreUpdated, kafka, []string{cluster2}},
+		{StoreDeleted, kafka, []string{cluster2}},
+	}, changes)
+
+	// no changes after the subscription is canceled:
+	cancel()
+	cancel()
+	store.Delete(cluster1, web)
+	assert.Len(changes, 5)
+
+	// a subscriber without a replay gets only the changes:
+	changes = nil
+	defer store.Subscribe(func(event StoreEvent) {
+		changes = append(changes, change{event.Type, event.Entry.Name, event.Entry.Clusters})
+	}, false)()
+	store.Add(cluster1, kafka, nil)
+	assert.Equal([]change{{StoreAdded, kafka, []string{cluster1}}}, changes)
+}
+
+// TestStoreConcurrent checks that the readers see whole changes while the store changes (run it with -race).
+func TestStoreConcurrent(t *testing.T) {
+	store := NewStore()
+	name := types.NamespacedName{Namespace: "test", Name: "myservice"}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			ttl := uint32(i)
+			store.Add(cluster1, name, &ServiceImportInfo{TTL: &ttl, IPs: []net.IP{net.IPv4(10, 0, byte(i>>8), byte(i)).To4()}})
+			store.Delete(cluster1, name)
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			require.False(t, store.HasNamespace("test"))
+			return
+		default:
+		}
+		if entry, exists := store.Get(name); exists {
+			ttl := *entry.TTL
+			require.Equal(t, []net.IP{net.IPv4(10, 0, byte(ttl>>8), byte(ttl)).To4()}, entry.IPs)
+		}
+	}
+}
+
+// The size of the store in the benchmarks, and the number of the goroutines that query it at once.
+const (
+	benchmarkImports = 100000
+	benchmarkReaders = 64
+)
+
+// newBenchmarkStore returns a store with benchmarkImports ServiceImports, in 100 namespaces.
+func newBenchmarkStore() (*Store, []types.NamespacedName) {
+	store := NewStore()
+	names := make([]types.NamespacedName, 0, benchmarkImports)
+	for i := 0; i < benchmarkImports; i++ {
+		name := types.NamespacedName{Namespace: fmt.Sprintf("ns-%d", i%100), Name: fmt.Sprintf("service-%d", i)}
+		store.Add(cluster1, name, &ServiceImportInfo{Type: mcsv1a1.ClusterSetIP,
+			IPs: []net.IP{net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).To4()}})
+		names = append(names, name)
+	}
+	return store, names
+}
+
+// runReaders runs b.N calls of read over benchmarkReaders goroutines. If write isn't nil, it is called
+// in a loop in the background meanwhile, as the reconcilers change the store.
+func runReaders(b *testing.B, read func(i int), write func(i int)) {
+	stop := make(chan struct{})
+	var writer sync.WaitGroup
+	if write != nil {
+		writer.Add(1)
+		go func() {
+			defer writer.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+					write(i)
+				}
+			}
+		}()
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var readers sync.WaitGroup
+	for r := 0; r < benchmarkReaders; r++ {
+		readers.Add(1)
+		go func(r int) {
+			defer readers.Done()
+			for i := r; i < b.N; i += benchmarkReaders {
+				read(i)
+			}
+		}(r)
+	}
+	readers.Wait()
+	b.StopTimer()
+	close(stop)
+	writer.Wait()
+}
+
+// updateBenchmarkStore changes the i-th ServiceImport of the store, as a reconciler does on an event.
+func updateBenchmarkStore(store *Store, names []types.NamespacedName, i int) {
+	ttl := uint32(i % 60)
+	store.Add(cluster1, names[i%len(names)], &ServiceImportInfo{Type: mcsv1a1.ClusterSetIP, TTL: &ttl,
+		IPs: []net.IP{net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).To4()}})
+}
+
+// rwMutexStore is the store as it was before copy on write, as the baseline of the benchmarks:
+// one map behind a read-write mutex, whose entries are merged from their clusters when they are read.
+type rwMutexStore struct {
+	mutex   sync.RWMutex
+	imports map[types.NamespacedName]map[string]*ServiceImportInfo
+}
+
+func newBenchmarkRWMutexStore() (*rwMutexStore, []types.NamespacedName) {
+	store := &rwMutexStore{imports: make(map[types.NamespacedName]map[string]*ServiceImportInfo)}
+	names := make([]types.NamespacedName, 0, benchmarkImports)
+	for i := 0; i < benchmarkImports; i++ {
+		name := types.NamespacedName{Namespace: fmt.Sprintf("ns-%d", i%100), Name: fmt.Sprintf("service-%d", i)}
+		store.add(cluster1, name, &ServiceImportInfo{Type: mcsv1a1.ClusterSetIP,
+			IPs: []net.IP{net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).To4()}})
+		names = append(names, name)
+	}
+	return store, names
+}
+
+func (s *rwMutexStore) add(cluster string, name types.NamespacedName, info *ServiceImportInfo) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	clusters, exists := s.imports[name]
+	if !exists {
+		clusters = make(map[string]*ServiceImportInfo)
+		s.imports[name] = clusters
+	}
+	clusters[cluster] = info
+}
+
+func (s *rwMutexStore) contains(name types.NamespacedName) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, exists := s.imports[name]
+	return exists
+}
+
+func (s *rwMutexStore) get(name types.NamespacedName) (ServiceImportEntry, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	clusters, exists := s.imports[name]
+	if !exists {
+		return ServiceImportEntry{}, false
+	}
+	return newEntry(name, clusters), true
+}
+
+func (s *rwMutexStore) update(names []types.NamespacedName, i int) {
+	ttl := uint32(i % 60)
+	s.add(cluster1, names[i%len(names)], &ServiceImportInfo{Type: mcsv1a1.ClusterSetIP, TTL: &ttl,
+		IPs: []net.IP{net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).To4()}})
+}
+
+func BenchmarkRWMutexStoreContains(b *testing.B) {
+	store, names := newBenchmarkRWMutexStore()
+	runReaders(b, func(i int) {
+		store.contains(names[i%len(names)])
+	}, nil)
+}
+
+func BenchmarkRWMutexStoreContainsWhileChanging(b *testing.B) {
+	store, names := newBenchmarkRWMutexStore()
+	runReaders(b, func(i int) {
+		store.contains(names[i%len(names)])
+	}, func(i int) {
+		store.update(names, i)
+	})
+}
+
+func BenchmarkRWMutexStoreGetWhileChanging(b *testing.B) {
+	store, names := newBenchmarkRWMutexStore()
+	runReaders(b, func(i int) {
+		store.get(names[i%len(names)])
+	}, func(i int) {
+		store.update(names, i)
+	})
+}
+
+// BenchmarkStoreAdd measures the cost of a change, which copies the shards it changes.
+func BenchmarkStoreAdd(b *testing.B) {
+	store, names := newBenchmarkStore()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		updateBenchmarkStore(store, names, i)
+	}
+}
+
+func BenchmarkStoreContains(b *testing.B) {
+	store, names := newBenchmarkStore()
+	runReaders(b, func(i int) {
+		store.Contains(names[i%len(names)])
+	}, nil)
+}
+
+func BenchmarkStoreContainsWhileChanging(b *testing.B) {
+	store, names := newBenchmarkStore()
+	runReaders(b, func(i int) {
+		store.Contains(names[i%len(names)])
+	}, func(i int) {
+		updateBenchmarkStore(store, names, i)
+	})
+}
+
+func BenchmarkStoreGetWhileChanging(b *testing.B) {
+	store, names := newBenchmarkStore()
+	runReaders(b, func(i int) {
+		store.Get(names[i%len(names)])
+	}, func(i int) {
+		updateBenchmarkStore(store, names, i)
+	})
+}